@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// defaultAuditFile is used when the config does not set audit.file
+const defaultAuditFile = "audit.jsonl"
+
+// AuditConfig holds where applied changes are recorded
+type AuditConfig struct {
+	File      string `yaml:"file"`      // local JSONL file, defaults to audit.jsonl
+	Kind      string `yaml:"kind"`      // optional Datastore kind that receives a copy of every record
+	Namespace string `yaml:"namespace"` // namespace of the audit kind
+}
+
+// AuditRecord describes one entity written to Datastore by an apply
+type AuditRecord struct {
+	Timestamp time.Time              `json:"timestamp"`
+	Operator  string                 `json:"operator"`
+	Commit    string                 `json:"commit,omitempty"`
+	Dirty     bool                   `json:"dirty,omitempty"`
+	Project   string                 `json:"project"`
+	Namespace string                 `json:"namespace"`
+	Kind      string                 `json:"kind"`
+	ID        string                 `json:"id"`
+	Parent    string                 `json:"parent,omitempty"`
+	Action    string                 `json:"action"`
+	Before    map[string]interface{} `json:"before,omitempty"`
+	After     map[string]interface{} `json:"after"`
+}
+
+// auditEntity is the shape stored in the audit kind; entity values are kept as JSON strings
+// since they routinely exceed the size limit of indexed properties
+type auditEntity struct {
+	Timestamp time.Time `datastore:"timestamp"`
+	Operator  string    `datastore:"operator"`
+	Commit    string    `datastore:"commit"`
+	Dirty     bool      `datastore:"dirty,noindex"`
+	Project   string    `datastore:"project"`
+	Namespace string    `datastore:"namespace"`
+	Kind      string    `datastore:"kind"`
+	ID        string    `datastore:"id"`
+	Parent    string    `datastore:"parent"`
+	Action    string    `datastore:"action"`
+	Before    string    `datastore:"before,noindex"`
+	After     string    `datastore:"after,noindex"`
+}
+
+// auditLog appends records of applied changes to the local file and the optional audit kind
+type auditLog struct {
+	config   AuditConfig
+	client   *datastore.Client
+	operator string
+	commit   string
+	dirty    bool
+}
+
+// newAuditLog prepares an audit log for changes applied from applyDir
+func newAuditLog(config AuditConfig, client *datastore.Client, applyDir string) *auditLog {
+	if config.File == "" {
+		config.File = defaultAuditFile
+	}
+	commit, dirty := gitRevision(applyDir)
+	return &auditLog{
+		config:   config,
+		client:   client,
+		operator: currentOperator(),
+		commit:   commit,
+		dirty:    dirty,
+	}
+}
+
+// Record stamps the record with the operator and change set revision and stores it
+func (a *auditLog) Record(ctx context.Context, record AuditRecord) error {
+	record.Timestamp = time.Now().UTC()
+	record.Operator = a.operator
+	record.Commit = a.commit
+	record.Dirty = a.dirty
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal audit record: %v", err)
+	}
+	if dir := filepath.Dir(a.config.File); dir != "." {
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			return fmt.Errorf("failed to create audit directory %s: %v", dir, err)
+		}
+	}
+	f, err := os.OpenFile(a.config.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open audit file %s: %v", a.config.File, err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit file %s: %v", a.config.File, err)
+	}
+
+	if a.config.Kind == "" || a.client == nil {
+		return nil
+	}
+	entity, err := record.toEntity()
+	if err != nil {
+		return err
+	}
+	key := datastore.IncompleteKey(a.config.Kind, nil)
+	key.Namespace = a.config.Namespace
+	if _, err := a.client.Put(ctx, key, &entity); err != nil {
+		return fmt.Errorf("failed to store audit record in kind %s: %v", a.config.Kind, err)
+	}
+	return nil
+}
+
+func (r AuditRecord) toEntity() (auditEntity, error) {
+	entity := auditEntity{
+		Timestamp: r.Timestamp,
+		Operator:  r.Operator,
+		Commit:    r.Commit,
+		Dirty:     r.Dirty,
+		Project:   r.Project,
+		Namespace: r.Namespace,
+		Kind:      r.Kind,
+		ID:        r.ID,
+		Parent:    r.Parent,
+		Action:    r.Action,
+	}
+	if r.Before != nil {
+		before, err := json.Marshal(r.Before)
+		if err != nil {
+			return entity, fmt.Errorf("failed to marshal audit before value: %v", err)
+		}
+		entity.Before = string(before)
+	}
+	after, err := json.Marshal(r.After)
+	if err != nil {
+		return entity, fmt.Errorf("failed to marshal audit after value: %v", err)
+	}
+	entity.After = string(after)
+	return entity, nil
+}
+
+func (e auditEntity) toRecord() (AuditRecord, error) {
+	record := AuditRecord{
+		Timestamp: e.Timestamp,
+		Operator:  e.Operator,
+		Commit:    e.Commit,
+		Dirty:     e.Dirty,
+		Project:   e.Project,
+		Namespace: e.Namespace,
+		Kind:      e.Kind,
+		ID:        e.ID,
+		Parent:    e.Parent,
+		Action:    e.Action,
+	}
+	if e.Before != "" {
+		if err := json.Unmarshal([]byte(e.Before), &record.Before); err != nil {
+			return record, fmt.Errorf("failed to parse audit before value: %v", err)
+		}
+	}
+	if err := json.Unmarshal([]byte(e.After), &record.After); err != nil {
+		return record, fmt.Errorf("failed to parse audit after value: %v", err)
+	}
+	return record, nil
+}
+
+// currentOperator names who runs the tool: PAVEN_OPERATOR, the git user email or the OS user
+func currentOperator() string {
+	if operator := os.Getenv("PAVEN_OPERATOR"); operator != "" {
+		return operator
+	}
+	if out, err := exec.Command("git", "config", "user.email").Output(); err == nil {
+		if email := strings.TrimSpace(string(out)); email != "" {
+			return email
+		}
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "unknown"
+}
+
+// gitRevision returns the commit checked out for dir and whether dir has uncommitted changes.
+// Both are empty when dir is not inside a git work tree.
+func gitRevision(dir string) (string, bool) {
+	out, err := exec.Command("git", "-C", dir, "rev-parse", "HEAD").Output()
+	if err != nil {
+		return "", false
+	}
+	status, err := exec.Command("git", "-C", dir, "status", "--porcelain", "--", ".").Output()
+	return strings.TrimSpace(string(out)), err == nil && len(strings.TrimSpace(string(status))) > 0
+}
+
+// loadAuditRecords reads the audit trail of a kind from the audit kind when configured, or the local file otherwise
+func loadAuditRecords(config Config, kind string) ([]AuditRecord, error) {
+	audit := config.Audit
+	if audit.Kind != "" {
+		ctx := context.Background()
+		client, err := datastore.NewClient(ctx, config.ProjectID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create datastore client: %v", err)
+		}
+		defer client.Close()
+
+		var entities []auditEntity
+		query := datastore.NewQuery(audit.Kind).Namespace(audit.Namespace).FilterField("kind", "=", kind)
+		if _, err := client.GetAll(ctx, query, &entities); err != nil {
+			return nil, fmt.Errorf("failed to query audit kind %s: %v", audit.Kind, err)
+		}
+		var records []AuditRecord
+		for _, entity := range entities {
+			record, err := entity.toRecord()
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, record)
+		}
+		return records, nil
+	}
+
+	if audit.File == "" {
+		audit.File = defaultAuditFile
+	}
+	f, err := os.Open(audit.File)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit file %s: %v", audit.File, err)
+	}
+	defer f.Close()
+
+	var records []AuditRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1024*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, fmt.Errorf("failed to parse audit file %s line %d: %v", audit.File, line, err)
+		}
+		if record.Kind == kind {
+			records = append(records, record)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit file %s: %v", audit.File, err)
+	}
+	return records, nil
+}
+
+// showHistory prints the audit trail of an entity given as "kind,id", or of a whole kind given as "kind"
+func showHistory(config Config, target string) error {
+	kind, id, _ := strings.Cut(target, ",")
+	if kind == "" {
+		return fmt.Errorf("history expects <kind,id> or <kind>, got %q", target)
+	}
+
+	records, err := loadAuditRecords(config, kind)
+	if err != nil {
+		return err
+	}
+
+	var matches []AuditRecord
+	for _, record := range records {
+		if id == "" || record.ID == id {
+			matches = append(matches, record)
+		}
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].Timestamp.Before(matches[j].Timestamp)
+	})
+
+	if len(matches) == 0 {
+		logInfo(fmt.Sprintf("No audit records found for %s", target))
+		return nil
+	}
+
+	for _, record := range matches {
+		commit := record.Commit
+		if commit == "" {
+			commit = "no commit"
+		} else if record.Dirty {
+			commit += " (uncommitted changes)"
+		}
+		before := record.Before
+		if before == nil {
+			before = map[string]interface{}{}
+		}
+		diffs := propertyDiff("data", before, record.After)
+		if logAsJSON {
+			logInfo("Audit record", "timestamp", record.Timestamp.Format(time.RFC3339), "action", record.Action,
+				"project", record.Project, "namespace", record.Namespace, "kind", record.Kind, "key", record.ID,
+				"operator", record.Operator, "commit", commit, "differences", diffs)
+			continue
+		}
+		fmt.Printf("%s%s  %s  %s %s,%s  project %s  by %s  [%s]%s\n", colorCyan,
+			record.Timestamp.Local().Format(time.RFC3339), strings.ToUpper(record.Action),
+			record.Namespace, record.Kind, record.ID, record.Project, record.Operator, commit, colorReset)
+		for _, diff := range diffs {
+			fmt.Printf("    %s\n", diff)
+		}
+		fmt.Println()
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+)
+
+// Defaults of the colour analysis
+var (
+	defaultColorProperties = []string{"*Color", "*Colors", "color", "*Hex"}
+	defaultMinContrast     = 4.5
+)
+
+// hexColor matches the #RRGGBB and #RRGGBBAA values the apps accept
+var hexColor = regexp.MustCompile(`^#([0-9A-Fa-f]{6}|[0-9A-Fa-f]{8})$`)
+
+// ColorsConfig tells the colour analysis which properties hold colours and which of them are
+// drawn on top of each other
+type ColorsConfig struct {
+	// Properties are glob patterns of the property names holding a colour or a list of colours
+	Properties  []string          `yaml:"properties"`
+	MinContrast float64           `yaml:"minContrast"` // default 4.5, the WCAG AA level for normal text
+	Pairs       []ColorPairConfig `yaml:"pairs"`
+}
+
+// ColorPairConfig declares a foreground drawn on a background. Path selects the objects holding
+// both colours (data when empty), Foreground and Background are property paths inside each of
+// them. Every foreground found is checked against every background found in the same object.
+type ColorPairConfig struct {
+	Kind        string  `yaml:"kind"`
+	Namespace   string  `yaml:"namespace"` // every namespace when empty
+	Path        string  `yaml:"path"`
+	Foreground  string  `yaml:"foreground"`
+	Background  string  `yaml:"background"`
+	MinContrast float64 `yaml:"minContrast"` // colors.minContrast when zero
+}
+
+// rgba is a parsed colour with channels between 0 and 1
+type rgba struct {
+	r, g, b, a float64
+}
+
+// analyzeColors checks the syntax of every colour value and the contrast of the configured pairs.
+// Malformed values and pairs below their minimum contrast are logged as errors and counted as one
+// failure per entity, 8-digit values are logged as warnings since the apps disagree on where the
+// alpha channel goes. It returns the number of errors.
+func analyzeColors(config Config, data lintData, summary *RunSummary) (int, error) {
+	settings := config.Colors
+	if len(settings.Properties) == 0 {
+		settings.Properties = defaultColorProperties
+	}
+	if settings.MinContrast == 0 {
+		settings.MinContrast = defaultMinContrast
+	}
+
+	type parsedPair struct {
+		rule                         ColorPairConfig
+		path, foreground, background propertyPath
+	}
+	pairs := make(map[string][]parsedPair)
+	for _, rule := range settings.Pairs {
+		if rule.Path == "" {
+			rule.Path = "data"
+		}
+		if rule.MinContrast == 0 {
+			rule.MinContrast = settings.MinContrast
+		}
+		pair := parsedPair{rule: rule}
+		var err error
+		if pair.path, err = parsePropertyPath(rule.Path); err == nil {
+			if pair.foreground, err = parsePropertyPath(rule.Foreground); err == nil {
+				pair.background, err = parsePropertyPath(rule.Background)
+			}
+		}
+		if err != nil {
+			return 0, fmt.Errorf("colour pair %s %s on %s: %v", rule.Kind, rule.Foreground, rule.Background, err)
+		}
+		pairs[rule.Kind] = append(pairs[rule.Kind], pair)
+	}
+
+	errors := 0
+	for _, namespace := range sortedKeys(data) {
+		for _, kind := range sortedKeys(data[namespace]) {
+			for _, le := range data[namespace][kind] {
+				var problems []string
+				for _, use := range collectColors(le.value, settings.Properties, "") {
+					if !hexColor.MatchString(use.name) {
+						problems = append(problems, fmt.Sprintf("%s: %q is not a #RRGGBB or #RRGGBBAA colour", use.path, use.name))
+					} else if len(use.name) == 9 {
+						key := entityKeyString(le.entity)
+						logWarn(fmt.Sprintf("%s: entity %s: %s: %s has 8 digits, check whether the alpha channel comes first (#AARRGGBB) or last (#RRGGBBAA)", le.file, key, use.path, use.name),
+							entityFields(config.ProjectID, namespace, kind, key)...)
+					}
+				}
+
+				for _, pair := range pairs[kind] {
+					if pair.rule.Namespace != "" && pair.rule.Namespace != namespace {
+						continue
+					}
+					objects := make(map[string]interface{})
+					collectValues(le.value, pair.path, "", objects)
+					for _, objectPath := range sortedKeys(objects) {
+						foregrounds := colorValues(objects[objectPath], pair.foreground, objectPath)
+						backgrounds := colorValues(objects[objectPath], pair.background, objectPath)
+						for _, fg := range foregrounds {
+							for _, bg := range backgrounds {
+								fgColor, fgOK := parseHexColor(fg.name)
+								bgColor, bgOK := parseHexColor(bg.name)
+								if !fgOK || !bgOK {
+									// Already reported as malformed
+									continue
+								}
+								if ratio := contrastRatio(fgColor, bgColor); ratio < pair.rule.MinContrast {
+									problems = append(problems, fmt.Sprintf("%s %s on %s %s has a contrast of %.2f:1, below %.1f:1",
+										fg.path, fg.name, bg.path, bg.name, ratio, pair.rule.MinContrast))
+								}
+							}
+						}
+					}
+				}
+
+				if len(problems) == 0 {
+					continue
+				}
+				key := entityKeyString(le.entity)
+				for _, problem := range problems {
+					logError(fmt.Sprintf("%s: entity %s: %s", le.file, key, problem),
+						entityFields(config.ProjectID, namespace, kind, key)...)
+				}
+				errors += len(problems)
+				summary.Kind(namespace, kind).Failed++
+			}
+		}
+	}
+	return errors, nil
+}
+
+// collectColors returns the string values, or the strings of the list values, of the properties
+// whose name matches one of the patterns anywhere in value
+func collectColors(value interface{}, patterns []string, valuePath string) []namedUse {
+	var uses []namedUse
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, key := range sortedKeys(v) {
+			childPath := joinPath(valuePath, key)
+			if isColorProperty(key, patterns) {
+				if colors := colorStrings(v[key], childPath); len(colors) > 0 {
+					uses = append(uses, colors...)
+					continue
+				}
+			}
+			uses = append(uses, collectColors(v[key], patterns, childPath)...)
+		}
+	case []interface{}:
+		for i, item := range v {
+			uses = append(uses, collectColors(item, patterns, fmt.Sprintf("%s[%d]", valuePath, i))...)
+		}
+	}
+	return uses
+}
+
+func isColorProperty(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matchSegment(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// colorStrings returns a string value, or the strings of a list of gradient stops
+func colorStrings(value interface{}, valuePath string) []namedUse {
+	switch v := value.(type) {
+	case string:
+		return []namedUse{{name: v, path: valuePath}}
+	case []interface{}:
+		var uses []namedUse
+		for i, item := range v {
+			if s, ok := item.(string); ok {
+				uses = append(uses, namedUse{name: s, path: fmt.Sprintf("%s[%d]", valuePath, i)})
+			}
+		}
+		return uses
+	}
+	return nil
+}
+
+// colorValues returns the colours found at path inside object
+func colorValues(object interface{}, p propertyPath, objectPath string) []namedUse {
+	found := make(map[string]interface{})
+	collectValues(object, p, objectPath, found)
+	var uses []namedUse
+	for _, valuePath := range sortedKeys(found) {
+		uses = append(uses, colorStrings(found[valuePath], valuePath)...)
+	}
+	return uses
+}
+
+// parseHexColor parses #RRGGBB or #RRGGBBAA, the CSS order of the alpha channel
+func parseHexColor(value string) (rgba, bool) {
+	if !hexColor.MatchString(value) {
+		return rgba{}, false
+	}
+	channel := func(i int) float64 {
+		n, _ := strconv.ParseUint(value[1+2*i:3+2*i], 16, 8)
+		return float64(n) / 255
+	}
+	color := rgba{r: channel(0), g: channel(1), b: channel(2), a: 1}
+	if len(value) == 9 {
+		color.a = channel(3)
+	}
+	return color, true
+}
+
+// contrastRatio returns the WCAG 2 contrast ratio of a foreground drawn on a background, from 1
+// to 21. A translucent foreground is blended over the background, which is taken as opaque.
+func contrastRatio(fg, bg rgba) float64 {
+	blend := func(f, b float64) float64 {
+		return f*fg.a + b*(1-fg.a)
+	}
+	fg = rgba{r: blend(fg.r, bg.r), g: blend(fg.g, bg.g), b: blend(fg.b, bg.b), a: 1}
+	l1, l2 := relativeLuminance(fg), relativeLuminance(bg)
+	if l1 < l2 {
+		l1, l2 = l2, l1
+	}
+	return (l1 + 0.05) / (l2 + 0.05)
+}
+
+// relativeLuminance returns the WCAG relative luminance of an sRGB colour
+func relativeLuminance(c rgba) float64 {
+	linear := func(v float64) float64 {
+		if v <= 0.03928 {
+			return v / 12.92
+		}
+		return math.Pow((v+0.055)/1.055, 2.4)
+	}
+	return 0.2126*linear(c.r) + 0.7152*linear(c.g) + 0.0722*linear(c.b)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"paven-go/dsvalue"
+)
+
+// convertFile converts a JSON document between the typed JSON of the Datastore REST API, as
+// written by the utils-clean scripts, and plain JSON. to is "plain" or "typed", out "-" for stdout.
+func convertFile(to, path, out string) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	document, err := decodeJSONDocument(content)
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	var converted interface{}
+	switch to {
+	case "plain":
+		if !dsvalue.IsTypedDocument(document) {
+			return fmt.Errorf("%s is not typed JSON", path)
+		}
+		value, err := dsvalue.DecodeDocument(document)
+		if err != nil {
+			return fmt.Errorf("invalid typed JSON in %s: %v", path, err)
+		}
+		converted = dsvalue.ToJSON(value)
+	case "typed":
+		if dsvalue.IsTypedDocument(document) {
+			return fmt.Errorf("%s is already typed JSON", path)
+		}
+		if converted, err = dsvalue.EncodeDocument(dsvalue.FromJSON(document)); err != nil {
+			return fmt.Errorf("failed to convert %s: %v", path, err)
+		}
+	default:
+		return fmt.Errorf("unknown format %q (use plain or typed)", to)
+	}
+
+	jsonData, err := json.MarshalIndent(converted, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %v", path, err)
+	}
+	jsonData = append(jsonData, '\n')
+	if out == "" || out == "-" {
+		_, err := os.Stdout.Write(jsonData)
+		return err
+	}
+	if filepath.Clean(out) == filepath.Clean(path) {
+		return fmt.Errorf("refusing to overwrite the input file %s", path)
+	}
+	if err := os.MkdirAll(filepath.Dir(out), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %v", out, err)
+	}
+	if err := ioutil.WriteFile(out, jsonData, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", out, err)
+	}
+	return nil
+}
+
+// convertToKindFile decodes typed JSON files and writes them as entities to the kind file of the
+// changes directory, so apply can take the files of the utils-clean scripts. target is <kind> for
+// one entity per file, named after the file, <kind>/<id> for a single file, or
+// <kind>/<id>.<property> to set one property of that entity as found in the changes directory or
+// the download, like the generators do.
+func convertToKindFile(target string, files []string, opts generateOptions, summary *RunSummary) error {
+	kind, entityID, _ := strings.Cut(target, "/")
+	entityID, property, _ := strings.Cut(entityID, ".")
+	if kind == "" || (property == "" && strings.HasSuffix(target, ".")) {
+		return fmt.Errorf("invalid target %q, expected <kind>, <kind>/<id> or <kind>/<id>.<property>", target)
+	}
+	if entityID != "" && len(files) > 1 {
+		return fmt.Errorf("%s names one entity, convert its files one at a time", target)
+	}
+	opts.Kind = kind
+
+	var entities []OutputEntity
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", file, err)
+		}
+		document, err := decodeJSONDocument(content)
+		if err != nil {
+			return fmt.Errorf("failed to parse %s: %v", file, err)
+		}
+		if !dsvalue.IsTypedDocument(document) {
+			return fmt.Errorf("%s is not typed JSON", file)
+		}
+		value, err := dsvalue.DecodeDocument(document)
+		if err != nil {
+			return fmt.Errorf("invalid typed JSON in %s: %v", file, err)
+		}
+		id := entityID
+		if id == "" {
+			id = strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+		}
+		if property != "" {
+			entity, err := withProperty(opts, kind, id, property, dsvalue.ToJSON(value))
+			if err != nil {
+				return err
+			}
+			entities = append(entities, entity)
+			continue
+		}
+		data, ok := dsvalue.ToJSON(value).(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s is not an entity, name the property it sets as %s/%s.<property>", file, kind, id)
+		}
+		entities = append(entities, OutputEntity{ID: id, Data: data})
+	}
+	_, err := writeGeneratedEntities(opts, entities, summary)
+	return err
+}
+
+// checkTypedFiles checks the typed JSON files, or every .json file under the directories, given in
+// paths for values Datastore rejects, such as arrays nested in arrays. Every problem is logged as
+// an error and the number of problems is returned.
+func checkTypedFiles(paths []string) (int, error) {
+	var files []string
+	for _, path := range paths {
+		err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() && filepath.Ext(file) == ".json" {
+				files = append(files, file)
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to read %s: %v", path, err)
+		}
+	}
+
+	problems := 0
+	for _, file := range files {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return problems, fmt.Errorf("failed to read %s: %v", file, err)
+		}
+		document, err := decodeJSONDocument(content)
+		if err != nil {
+			problems++
+			logError(fmt.Sprintf("Invalid JSON: %v", err), "file", file)
+			continue
+		}
+		if !dsvalue.IsTypedDocument(document) {
+			logDebug("Not typed JSON, skipping", "file", file)
+			continue
+		}
+		found := dsvalue.CheckDocument(document)
+		for _, problem := range found {
+			logError("Invalid value: "+problem.Message, "file", file, "path", problem.Path)
+		}
+		if len(found) == 0 {
+			logInfo("Valid typed JSON", "file", file)
+		}
+		problems += len(found)
+	}
+	return problems, nil
+}
+
+// decodeJSONDocument parses JSON keeping numbers exact, int64 values do not fit in a float64
+func decodeJSONDocument(content []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	var document interface{}
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+	return document, nil
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"paven-go/dsvalue"
+)
+
+// propertyPath is a parsed property path such as data.elements[*].id. Map key segments
+// are glob patterns (data.*At), array selectors are an index or "*" for any index.
+type propertyPath []string
+
+// parsePropertyPath splits a dotted path with [index] or [*] array selectors into segments
+func parsePropertyPath(path string) (propertyPath, error) {
+	var segments propertyPath
+	for _, part := range strings.Split(path, ".") {
+		name := part
+		var selectors []string
+		if i := strings.Index(part, "["); i >= 0 {
+			name = part[:i]
+			rest := part[i:]
+			for rest != "" {
+				end := strings.Index(rest, "]")
+				if rest[0] != '[' || end < 0 {
+					return nil, fmt.Errorf("invalid array selector in path %q", path)
+				}
+				selector := rest[1:end]
+				if _, err := strconv.Atoi(selector); err != nil && selector != "*" {
+					return nil, fmt.Errorf("invalid array selector [%s] in path %q", selector, path)
+				}
+				selectors = append(selectors, selector)
+				rest = rest[end+1:]
+			}
+		}
+		if name == "" && len(selectors) == 0 {
+			return nil, fmt.Errorf("empty segment in path %q", path)
+		}
+		if name != "" {
+			segments = append(segments, name)
+		}
+		segments = append(segments, selectors...)
+	}
+	return segments, nil
+}
+
+// arrayRule makes the arrays at path order-insensitive. Items are matched by the value of
+// their key property, or by their whole value when key is empty (the array is a set).
+type arrayRule struct {
+	path propertyPath
+	key  string
+}
+
+// kindRules holds the comparison rules of one kind, parsed from its KindConfig
+type kindRules struct {
+	ignore          []propertyPath
+	preserveIgnored bool
+	arrays          []arrayRule
+}
+
+// diffRules holds the comparison rules of every configured kind
+type diffRules struct {
+	kinds map[string]*kindRules
+}
+
+// newDiffRules parses the comparison rules of the configured kinds
+func newDiffRules(config Config) (*diffRules, error) {
+	rules := &diffRules{kinds: make(map[string]*kindRules)}
+	for _, kc := range config.Kinds {
+		kr := &kindRules{preserveIgnored: kc.PreserveIgnored}
+		for _, path := range kc.Ignore {
+			parsed, err := parsePropertyPath(path)
+			if err != nil {
+				return nil, fmt.Errorf("kind %s: %v", kc.Name, err)
+			}
+			kr.ignore = append(kr.ignore, parsed)
+		}
+		for _, ac := range kc.Arrays {
+			parsed, err := parsePropertyPath(ac.Path)
+			if err != nil {
+				return nil, fmt.Errorf("kind %s: %v", kc.Name, err)
+			}
+			kr.arrays = append(kr.arrays, arrayRule{path: parsed, key: ac.Key})
+		}
+		rules.kinds[kc.Namespace+"/"+kc.Name] = kr
+	}
+	return rules, nil
+}
+
+// forKind returns the rules of the kind, or empty rules when the kind is not configured
+func (r *diffRules) forKind(namespace, kind string) *kindRules {
+	if r != nil {
+		if kr, ok := r.kinds[namespace+"/"+kind]; ok {
+			return kr
+		}
+	}
+	return &kindRules{}
+}
+
+// stripIgnored returns a copy of an entity with the ignored properties removed
+func (kr *kindRules) stripIgnored(entity interface{}) interface{} {
+	stripped := copyValue(entity)
+	for _, path := range kr.ignore {
+		stripped = removePath(stripped, path)
+	}
+	return stripped
+}
+
+// preserveData copies the remote values of the ignored properties into the local data map,
+// so volatile properties such as timestamps survive an apply. Properties the remote side
+// does not have keep their local value.
+func (kr *kindRules) preserveData(local, remote map[string]interface{}) map[string]interface{} {
+	if !kr.preserveIgnored || remote == nil {
+		return local
+	}
+	localEntity := map[string]interface{}{"data": copyValue(local)}
+	remoteEntity := map[string]interface{}{"data": remote}
+	for _, path := range kr.ignore {
+		copyPath(localEntity, remoteEntity, path)
+	}
+	return localEntity["data"].(map[string]interface{})
+}
+
+// copyValue deep copies maps and slices decoded from JSON
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			copied[key] = copyValue(val)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, val := range v {
+			copied[i] = copyValue(val)
+		}
+		return copied
+	default:
+		return v
+	}
+}
+
+// removePath deletes every property matching path from value
+func removePath(value interface{}, path propertyPath) interface{} {
+	if len(path) == 0 {
+		return value
+	}
+	segment, last := path[0], len(path) == 1
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key := range v {
+			if !matchSegment(segment, key) {
+				continue
+			}
+			if last {
+				delete(v, key)
+			} else {
+				v[key] = removePath(v[key], path[1:])
+			}
+		}
+		return v
+	case []interface{}:
+		kept := make([]interface{}, 0, len(v))
+		for i, item := range v {
+			matches := segment == "*" || segment == strconv.Itoa(i)
+			if matches && last {
+				continue
+			}
+			if matches {
+				item = removePath(item, path[1:])
+			}
+			kept = append(kept, item)
+		}
+		return kept
+	default:
+		return v
+	}
+}
+
+// copyPath sets every property matching path in local to its value in remote,
+// as long as both sides have the containing map or array
+func copyPath(local, remote interface{}, path propertyPath) {
+	if len(path) == 0 {
+		return
+	}
+	segment, last := path[0], len(path) == 1
+
+	switch r := remote.(type) {
+	case map[string]interface{}:
+		l, ok := local.(map[string]interface{})
+		if !ok {
+			return
+		}
+		for key, val := range r {
+			if !matchSegment(segment, key) {
+				continue
+			}
+			if last {
+				l[key] = copyValue(val)
+			} else if _, exists := l[key]; exists {
+				copyPath(l[key], val, path[1:])
+			}
+		}
+	case []interface{}:
+		l, ok := local.([]interface{})
+		if !ok {
+			return
+		}
+		for i, val := range r {
+			if i >= len(l) || (segment != "*" && segment != strconv.Itoa(i)) {
+				continue
+			}
+			if last {
+				l[i] = copyValue(val)
+			} else {
+				copyPath(l[i], val, path[1:])
+			}
+		}
+	}
+}
+
+// matchSegment reports whether a map key matches a path segment pattern
+func matchSegment(segment, key string) bool {
+	matched, err := path.Match(segment, key)
+	return err == nil && matched
+}
+
+// itemIdentity returns what identifies an array item: its key property, or the item itself for sets
+func itemIdentity(item interface{}, key string) interface{} {
+	if key == "" {
+		return item
+	}
+	if m, ok := item.(map[string]interface{}); ok {
+		return m[key]
+	}
+	return nil
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// canonicalJSON encodes a value with sorted map keys and whole numbers without decimals
+func canonicalJSON(value interface{}) string {
+	data, err := json.Marshal(dsvalue.Plain(value))
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(data)
+}
+
+// arrayMoves describes the items of order-insensitive arrays whose relative position
+// changed between two versions of an entity's data. Ignored properties are left out.
+func (kr *kindRules) arrayMoves(before, after map[string]interface{}) []string {
+	var moves []string
+	beforeEntity := kr.stripIgnored(map[string]interface{}{"data": before})
+	afterEntity := kr.stripIgnored(map[string]interface{}{"data": after})
+
+	for _, rule := range kr.arrays {
+		beforeArrays := make(map[string][]interface{})
+		afterArrays := make(map[string][]interface{})
+		collectArrays(beforeEntity, rule.path, "", beforeArrays)
+		collectArrays(afterEntity, rule.path, "", afterArrays)
+
+		var paths []string
+		for p := range afterArrays {
+			if _, ok := beforeArrays[p]; ok {
+				paths = append(paths, p)
+			}
+		}
+		sort.Strings(paths)
+		for _, p := range paths {
+			// Labelled inside the data like the lines of dataChanges, e.g. steps[order=2]
+			moves = append(moves, movedItems(strings.TrimPrefix(p, "data."), beforeArrays[p], afterArrays[p], rule.key)...)
+		}
+	}
+	return moves
+}
+
+// collectArrays gathers the arrays matching path, keyed by their concrete dotted path
+func collectArrays(value interface{}, path propertyPath, prefix string, out map[string][]interface{}) {
+	if len(path) == 0 {
+		if items, ok := value.([]interface{}); ok {
+			out[prefix] = items
+		}
+		return
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			if matchSegment(path[0], k) {
+				next := k
+				if prefix != "" {
+					next = prefix + "." + k
+				}
+				collectArrays(val, path[1:], next, out)
+			}
+		}
+	case []interface{}:
+		for i, val := range v {
+			if path[0] == "*" || path[0] == strconv.Itoa(i) {
+				collectArrays(val, path[1:], fmt.Sprintf("%s[%d]", prefix, i), out)
+			}
+		}
+	}
+}
+
+// movedItems reports the items present on both sides that are not part of the longest
+// common subsequence of identities, i.e. the items that were moved rather than kept in place
+func movedItems(path string, before, after []interface{}, key string) []string {
+	beforeIDs := make([]string, len(before))
+	for i, item := range before {
+		beforeIDs[i] = canonicalJSON(itemIdentity(item, key))
+	}
+	afterIDs := make([]string, len(after))
+	for i, item := range after {
+		afterIDs[i] = canonicalJSON(itemIdentity(item, key))
+	}
+
+	// Longest common subsequence table over the identities
+	lcs := make([][]int, len(beforeIDs)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(afterIDs)+1)
+	}
+	for i := len(beforeIDs) - 1; i >= 0; i-- {
+		for j := len(afterIDs) - 1; j >= 0; j-- {
+			if beforeIDs[i] == afterIDs[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	inPlace := make(map[int]bool)
+	matchedBefore := make(map[int]bool)
+	for i, j := 0, 0; i < len(beforeIDs) && j < len(afterIDs); {
+		switch {
+		case beforeIDs[i] == afterIDs[j]:
+			inPlace[j] = true
+			matchedBefore[i] = true
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			i++
+		default:
+			j++
+		}
+	}
+
+	var moves []string
+	for j, id := range afterIDs {
+		if inPlace[j] {
+			continue
+		}
+		for i, beforeID := range beforeIDs {
+			if beforeID == id && !matchedBefore[i] {
+				matchedBefore[i] = true
+				moves = append(moves, fmt.Sprintf("%s: moved from index %d to %d", identityLabel(path, id, key), i, j))
+				break
+			}
+		}
+	}
+	return moves
+}
+
+// propertyChange is one difference between two versions of a value: a property or array item
+// that was added, removed or changed
+type propertyChange struct {
+	Path   string
+	Action string // added, removed or changed
+	Before interface{}
+	After  interface{}
+}
+
+func (c propertyChange) String() string {
+	switch c.Action {
+	case "added":
+		return fmt.Sprintf("%s: added %s", c.Path, shortJSON(c.After))
+	case "removed":
+		return fmt.Sprintf("%s: removed %s", c.Path, shortJSON(c.Before))
+	}
+	return fmt.Sprintf("%s: %s -> %s", c.Path, shortJSON(c.Before), shortJSON(c.After))
+}
+
+// diffData lists the differences between two versions of an entity's data, one line per
+// property path, leaving out the ignored properties
+func (kr *kindRules) diffData(before, after map[string]interface{}) []string {
+	var diff []string
+	for _, change := range kr.dataChanges(before, after) {
+		diff = append(diff, change.String())
+	}
+	return diff
+}
+
+// dataChanges lists the differences between two versions of an entity's data. Items of
+// order-insensitive arrays are matched by their identity, so inserting or removing one reports
+// only that item and reordering reports nothing (see arrayMoves); other arrays are compared by
+// position.
+func (kr *kindRules) dataChanges(before, after map[string]interface{}) []propertyChange {
+	strippedBefore := kr.stripIgnored(map[string]interface{}{"data": before}).(map[string]interface{})
+	strippedAfter := kr.stripIgnored(map[string]interface{}{"data": after}).(map[string]interface{})
+	return kr.changes("", propertyPath{"data"}, strippedBefore["data"], strippedAfter["data"])
+}
+
+// changes compares two values found at the concrete path segments, labelled path in the result
+func (kr *kindRules) changes(path string, segments propertyPath, before, after interface{}) []propertyChange {
+	beforeMap, beforeIsMap := before.(map[string]interface{})
+	afterMap, afterIsMap := after.(map[string]interface{})
+	if beforeIsMap && afterIsMap {
+		keys := sortedKeys(beforeMap)
+		for _, key := range sortedKeys(afterMap) {
+			if _, ok := beforeMap[key]; !ok {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+
+		var changes []propertyChange
+		for _, key := range keys {
+			childPath := joinPath(path, key)
+			beforeValue, inBefore := beforeMap[key]
+			afterValue, inAfter := afterMap[key]
+			switch {
+			case !inBefore:
+				changes = append(changes, propertyChange{Path: childPath, Action: "added", After: afterValue})
+			case !inAfter:
+				changes = append(changes, propertyChange{Path: childPath, Action: "removed", Before: beforeValue})
+			default:
+				changes = append(changes, kr.changes(childPath, withSegment(segments, key), beforeValue, afterValue)...)
+			}
+		}
+		return changes
+	}
+
+	beforeList, beforeIsList := before.([]interface{})
+	afterList, afterIsList := after.([]interface{})
+	if beforeIsList && afterIsList {
+		if rule, ok := kr.arrayRuleAt(segments); ok {
+			return kr.itemChanges(path, segments, beforeList, afterList, rule.key)
+		}
+		var changes []propertyChange
+		for i := 0; i < len(beforeList) || i < len(afterList); i++ {
+			childPath := fmt.Sprintf("%s[%d]", path, i)
+			switch {
+			case i >= len(beforeList):
+				changes = append(changes, propertyChange{Path: childPath, Action: "added", After: afterList[i]})
+			case i >= len(afterList):
+				changes = append(changes, propertyChange{Path: childPath, Action: "removed", Before: beforeList[i]})
+			default:
+				changes = append(changes, kr.changes(childPath, withSegment(segments, strconv.Itoa(i)), beforeList[i], afterList[i])...)
+			}
+		}
+		return changes
+	}
+
+	if canonicalJSON(before) != canonicalJSON(after) {
+		return []propertyChange{{Path: path, Action: "changed", Before: before, After: after}}
+	}
+	return nil
+}
+
+// itemChanges compares the items of an order-insensitive array by identity, labelling them
+// by key value (steps[order=2]) or, for sets, by value (tags["a"])
+func (kr *kindRules) itemChanges(path string, segments propertyPath, before, after []interface{}, key string) []propertyChange {
+	unmatched := make(map[string][]int)
+	for i, item := range before {
+		id := canonicalJSON(itemIdentity(item, key))
+		unmatched[id] = append(unmatched[id], i)
+	}
+
+	var changes []propertyChange
+	for j, item := range after {
+		id := canonicalJSON(itemIdentity(item, key))
+		itemPath := identityLabel(path, id, key)
+		candidates := unmatched[id]
+		if len(candidates) == 0 {
+			changes = append(changes, propertyChange{Path: itemPath, Action: "added", After: item})
+			continue
+		}
+		unmatched[id] = candidates[1:]
+		changes = append(changes, kr.changes(itemPath, withSegment(segments, strconv.Itoa(j)), before[candidates[0]], item)...)
+	}
+
+	removed := make(map[int]bool)
+	for _, indexes := range unmatched {
+		for _, i := range indexes {
+			removed[i] = true
+		}
+	}
+	for i, item := range before {
+		if removed[i] {
+			changes = append(changes, propertyChange{Path: identityLabel(path, canonicalJSON(itemIdentity(item, key)), key), Action: "removed", Before: item})
+		}
+	}
+	return changes
+}
+
+// arrayRuleAt returns the order-insensitive array rule matching the concrete path segments
+func (kr *kindRules) arrayRuleAt(segments propertyPath) (arrayRule, bool) {
+	for _, rule := range kr.arrays {
+		if len(rule.path) != len(segments) {
+			continue
+		}
+		matched := true
+		for i, segment := range segments {
+			if !matchSegment(rule.path[i], segment) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return rule, true
+		}
+	}
+	return arrayRule{}, false
+}
+
+// withSegment returns a copy of the segments with one more segment
+func withSegment(segments propertyPath, segment string) propertyPath {
+	return append(append(propertyPath{}, segments...), segment)
+}
+
+// identityLabel labels an item of an order-insensitive array by its identity
+func identityLabel(path, id, key string) string {
+	if key != "" {
+		return fmt.Sprintf("%s[%s=%s]", path, key, id)
+	}
+	if len(id) > 60 {
+		id = id[:57] + "..."
+	}
+	return fmt.Sprintf("%s[%s]", path, id)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+// step builds an item of a keyed steps array
+func step(order int64, page string) map[string]interface{} {
+	return map[string]interface{}{"order": order, "page": page}
+}
+
+func TestDiffDataMatchesArrayItemsByIdentity(t *testing.T) {
+	config := Config{Kinds: []KindConfig{{
+		Name:   "goalsConfig",
+		Arrays: []ArrayConfig{{Path: "data.steps", Key: "order"}, {Path: "data.tags"}},
+	}}}
+	rules, err := newDiffRules(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kr := rules.forKind("", "goalsConfig")
+
+	tests := []struct {
+		name          string
+		before, after map[string]interface{}
+		diff          []string
+		moves         []string
+	}{
+		{
+			name:   "keyed item removed in the middle",
+			before: map[string]interface{}{"steps": []interface{}{step(1, "a"), step(2, "b"), step(3, "c")}},
+			after:  map[string]interface{}{"steps": []interface{}{step(1, "a"), step(3, "c")}},
+			diff:   []string{`steps[order=2]: removed {"order":2,"page":"b"}`},
+		},
+		{
+			name:   "keyed item inserted in the middle",
+			before: map[string]interface{}{"steps": []interface{}{step(1, "a"), step(3, "c")}},
+			after:  map[string]interface{}{"steps": []interface{}{step(1, "a"), step(2, "b"), step(3, "c")}},
+			diff:   []string{`steps[order=2]: added {"order":2,"page":"b"}`},
+		},
+		{
+			name:   "keyed item changed and moved",
+			before: map[string]interface{}{"steps": []interface{}{step(1, "a"), step(2, "b"), step(3, "c")}},
+			after:  map[string]interface{}{"steps": []interface{}{step(3, "c"), step(1, "a"), step(2, "x")}},
+			diff:   []string{`steps[order=2].page: "b" -> "x"`},
+			moves:  []string{"steps[order=3]: moved from index 2 to 0"},
+		},
+		{
+			name:   "keyed items only reordered",
+			before: map[string]interface{}{"steps": []interface{}{step(1, "a"), step(2, "b")}},
+			after:  map[string]interface{}{"steps": []interface{}{step(2, "b"), step(1, "a")}},
+			moves:  []string{"steps[order=1]: moved from index 0 to 1"},
+		},
+		{
+			name:   "set item inserted and removed",
+			before: map[string]interface{}{"tags": []interface{}{"a", "b", "c"}},
+			after:  map[string]interface{}{"tags": []interface{}{"d", "a", "c"}},
+			diff:   []string{`tags["d"]: added "d"`, `tags["b"]: removed "b"`},
+		},
+		{
+			name:   "set only reordered",
+			before: map[string]interface{}{"tags": []interface{}{"a", "b"}},
+			after:  map[string]interface{}{"tags": []interface{}{"b", "a"}},
+			moves:  []string{`tags["a"]: moved from index 0 to 1`},
+		},
+		{
+			name:   "other arrays compare by position",
+			before: map[string]interface{}{"list": []interface{}{"a", "b"}},
+			after:  map[string]interface{}{"list": []interface{}{"b"}},
+			diff:   []string{`list[0]: "a" -> "b"`, `list[1]: removed "b"`},
+		},
+	}
+	for _, test := range tests {
+		if diff := deep.Equal(kr.diffData(test.before, test.after), test.diff); diff != nil {
+			t.Errorf("%s: diffData: %v", test.name, diff)
+		}
+		if diff := deep.Equal(kr.arrayMoves(test.before, test.after), test.moves); diff != nil {
+			t.Errorf("%s: arrayMoves: %v", test.name, diff)
+		}
+	}
+}
+
+func TestRemovePath(t *testing.T) {
+	entity := func() interface{} {
+		return map[string]interface{}{
+			"data": map[string]interface{}{
+				"title":     "t",
+				"updatedAt": "2024-01-01",
+				"steps": []interface{}{
+					map[string]interface{}{"page": "p1", "seenAt": "x", "hits": int64(1)},
+					map[string]interface{}{"page": "p2", "seenAt": "y", "hits": int64(2)},
+				},
+			},
+		}
+	}
+	steps := func(items ...map[string]interface{}) []interface{} {
+		var result []interface{}
+		for _, item := range items {
+			result = append(result, item)
+		}
+		return result
+	}
+
+	tests := []struct {
+		path string
+		want interface{}
+	}{
+		{"data.updatedAt", map[string]interface{}{"data": map[string]interface{}{
+			"title": "t",
+			"steps": steps(
+				map[string]interface{}{"page": "p1", "seenAt": "x", "hits": int64(1)},
+				map[string]interface{}{"page": "p2", "seenAt": "y", "hits": int64(2)}),
+		}}},
+		{"data.steps[*].seenAt", map[string]interface{}{"data": map[string]interface{}{
+			"title": "t", "updatedAt": "2024-01-01",
+			"steps": steps(
+				map[string]interface{}{"page": "p1", "hits": int64(1)},
+				map[string]interface{}{"page": "p2", "hits": int64(2)}),
+		}}},
+		{"data.steps[1].hits", map[string]interface{}{"data": map[string]interface{}{
+			"title": "t", "updatedAt": "2024-01-01",
+			"steps": steps(
+				map[string]interface{}{"page": "p1", "seenAt": "x", "hits": int64(1)},
+				map[string]interface{}{"page": "p2", "seenAt": "y"}),
+		}}},
+		{"data.steps[*]", map[string]interface{}{"data": map[string]interface{}{
+			"title": "t", "updatedAt": "2024-01-01", "steps": []interface{}{},
+		}}},
+		{"data.*At", map[string]interface{}{"data": map[string]interface{}{
+			"title": "t",
+			"steps": steps(
+				map[string]interface{}{"page": "p1", "seenAt": "x", "hits": int64(1)},
+				map[string]interface{}{"page": "p2", "seenAt": "y", "hits": int64(2)}),
+		}}},
+		{"data.missing[*].x", entity()},
+	}
+	for _, test := range tests {
+		path, err := parsePropertyPath(test.path)
+		if err != nil {
+			t.Fatalf("%s: %v", test.path, err)
+		}
+		if diff := deep.Equal(removePath(entity(), path), test.want); diff != nil {
+			t.Errorf("%s: %v", test.path, diff)
+		}
+	}
+}
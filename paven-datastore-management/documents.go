@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/datastore"
+
+	"paven-go/dsvalue"
+)
+
+// DocumentConfig maps a file of the changes directory to one property of an entity, so a large
+// embedded property such as the themes of journeys/config can be edited, compared and applied
+// without the rest of the entity
+type DocumentConfig struct {
+	// File is the name of the document in the changes directory, e.g. journeys-themes.json. It sits
+	// next to the namespace directories so it is never read as a kind file.
+	File      string `yaml:"file"`
+	Namespace string `yaml:"namespace"`
+	Kind      string `yaml:"kind"`
+	ID        string `yaml:"id"`
+	Parent    string `yaml:"parent"`   // kind,id of the parent, as in the kind files
+	Property  string `yaml:"property"` // property path inside the data, e.g. themes or config.colors
+}
+
+// target describes the property the document maps to, e.g. journeys/config.themes
+func (d DocumentConfig) target() string {
+	return fmt.Sprintf("%s/%s.%s", d.Kind, d.ID, d.Property)
+}
+
+// propertyNames splits the property path of the document
+func (d DocumentConfig) propertyNames() []string {
+	return strings.Split(d.Property, ".")
+}
+
+// checkDocuments validates the documents of the config
+func checkDocuments(config Config) error {
+	files := make(map[string]bool)
+	targets := make(map[string]bool)
+	for _, doc := range config.Documents {
+		if doc.File == "" || doc.Kind == "" || doc.ID == "" || doc.Property == "" {
+			return fmt.Errorf("document %q needs a file, kind, id and property", doc.File)
+		}
+		if filepath.Base(doc.File) != doc.File || filepath.Ext(doc.File) != ".json" {
+			return fmt.Errorf("document %s must be a .json file name, it is read from the top of the changes directory", doc.File)
+		}
+		for _, name := range doc.propertyNames() {
+			if name == "" {
+				return fmt.Errorf("document %s has an invalid property path %q", doc.File, doc.Property)
+			}
+		}
+		target := doc.Namespace + "/" + doc.Parent + "/" + doc.target()
+		if files[doc.File] || targets[target] {
+			return fmt.Errorf("document %s is configured twice", doc.File)
+		}
+		files[doc.File], targets[target] = true, true
+	}
+	return nil
+}
+
+// readDocument decodes a document from dir, returning false when the file is not there
+func readDocument(dir string, doc DocumentConfig) (interface{}, bool, error) {
+	path := filepath.Join(dir, doc.File)
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read document %s: %v", path, err)
+	}
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, false, fmt.Errorf("failed to parse document %s: %v", path, err)
+	}
+	return dsvalue.Plain(value), true, nil
+}
+
+// documentEntity returns the entity a document maps to from the kind file of dir, or nil
+func documentEntity(dir string, doc DocumentConfig) (*OutputEntity, error) {
+	entities, err := readKindFile(filepath.Join(dir, doc.Namespace, doc.Kind+".json"))
+	if err != nil {
+		return nil, err
+	}
+	for i := range entities {
+		if entities[i].ID == doc.ID && entities[i].Parent == doc.Parent {
+			return &entities[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// propertyValue returns the value at a property path of the data
+func propertyValue(data map[string]interface{}, names []string) (interface{}, bool) {
+	var value interface{} = data
+	for _, name := range names {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[name]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// withDocument returns a copy of the data with the property path of the document set to value,
+// creating the embedded entities on the way when they are missing
+func withDocument(data map[string]interface{}, doc DocumentConfig, value interface{}) (map[string]interface{}, error) {
+	result := make(map[string]interface{})
+	if data != nil {
+		result = copyValue(data).(map[string]interface{})
+	}
+	names := doc.propertyNames()
+	object := result
+	for i, name := range names[:len(names)-1] {
+		next, found := object[name]
+		if !found || next == nil {
+			next = make(map[string]interface{})
+			object[name] = next
+		}
+		nested, ok := next.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s is not an embedded entity", strings.Join(names[:i+1], "."))
+		}
+		object = nested
+	}
+	object[names[len(names)-1]] = value
+	return result, nil
+}
+
+// extractDocuments writes the current value of every configured document from the download into
+// dir, as a starting point for editing it
+func extractDocuments(config Config, outputDir, dir string) error {
+	if err := checkDocuments(config); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", dir, err)
+	}
+	for _, doc := range config.Documents {
+		entity, err := documentEntity(outputDir, doc)
+		if err != nil {
+			return err
+		}
+		if entity == nil {
+			return fmt.Errorf("no %s/%s entity in %s for document %s, download the %s kind first", doc.Kind, doc.ID, outputDir, doc.File, doc.Kind)
+		}
+		value, found := propertyValue(entity.Data, doc.propertyNames())
+		if !found {
+			logWarn(fmt.Sprintf("%s is not set, document %s starts empty", doc.target(), doc.File), "namespace", doc.Namespace, "kind", doc.Kind)
+		}
+		content, err := json.MarshalIndent(value, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal document %s: %v", doc.File, err)
+		}
+		path := filepath.Join(dir, doc.File)
+		if err := ioutil.WriteFile(path, content, 0644); err != nil {
+			return fmt.Errorf("failed to write document %s: %v", path, err)
+		}
+		logInfo(fmt.Sprintf("Extracted %s to %s", doc.target(), path), "namespace", doc.Namespace, "kind", doc.Kind)
+	}
+	return nil
+}
+
+// compareDocuments diffs every document of compareDir against the property it maps to in the
+// entities of outputDir, listing only the paths inside that property
+func compareDocuments(config Config, rules *diffRules, outputDir, compareDir string, summary *RunSummary) error {
+	if err := checkDocuments(config); err != nil {
+		return err
+	}
+	for _, doc := range config.Documents {
+		kindSummary := summary.Kind(doc.Namespace, doc.Kind)
+		fields := []any{"namespace", doc.Namespace, "kind", doc.Kind, "key", doc.ID, "file", doc.File}
+		value, found, err := readDocument(compareDir, doc)
+		if err != nil {
+			logError(err.Error(), fields...)
+			kindSummary.Failed++
+			continue
+		}
+		if !found {
+			logDebug(fmt.Sprintf("Document %s is not in %s", doc.File, compareDir), fields...)
+			continue
+		}
+		entity, err := documentEntity(outputDir, doc)
+		if err != nil {
+			logError(err.Error(), fields...)
+			kindSummary.Failed++
+			continue
+		}
+		if entity == nil {
+			logError(fmt.Sprintf("Document %s maps to %s, which is not in %s", doc.File, doc.target(), outputDir), fields...)
+			kindSummary.Failed++
+			continue
+		}
+
+		kindRules := rules.forKind(doc.Namespace, doc.Kind)
+		after, err := withDocument(entity.Data, doc, value)
+		if err != nil {
+			logError(fmt.Sprintf("Document %s cannot be set on %s: %v", doc.File, doc.target(), err), fields...)
+			kindSummary.Failed++
+			continue
+		}
+		diff := kindRules.diffData(entity.Data, after)
+		if len(diff) == 0 {
+			logInfo(fmt.Sprintf("Document %s matches %s", doc.File, doc.target()), fields...)
+			kindSummary.Unchanged++
+			continue
+		}
+		logInfo(fmt.Sprintf("Comparing document %s with %s", doc.File, doc.target()), fields...)
+		for _, line := range diff {
+			logDiff("CHANGED", line, colorYellow, fields...)
+		}
+		kindSummary.Updated++
+	}
+	return nil
+}
+
+// planDocuments adds the documents of applyDir to the plan. A document sets its property on the
+// change already planned for the entity, or on the entity fetched from Datastore, so the other
+// properties keep their current value. With merge the document is a merge patch on the property.
+// The entities documents change are checked against their schemas by applyChangesToDatabase.
+func planDocuments(ctx context.Context, client *datastore.Client, config Config, rules *diffRules, applyDir string, merge bool, plan *Plan, summary *RunSummary) error {
+	if err := checkDocuments(config); err != nil {
+		return err
+	}
+	for _, doc := range config.Documents {
+		kindSummary := summary.Kind(doc.Namespace, doc.Kind)
+		kindRules := rules.forKind(doc.Namespace, doc.Kind)
+		fields := append(entityFields(config.ProjectID, doc.Namespace, doc.Kind, doc.ID), "file", doc.File)
+		value, found, err := readDocument(applyDir, doc)
+		if err != nil {
+			logError(err.Error(), fields...)
+			kindSummary.Failed++
+			continue
+		}
+		if !found {
+			continue
+		}
+
+		var change *PlannedChange
+		for _, planned := range plan.Changes {
+			if planned.Namespace == doc.Namespace && planned.Kind == doc.Kind && planned.ID == doc.ID && planned.Parent == doc.Parent {
+				change = planned
+			}
+		}
+		fetched := change == nil
+		if fetched {
+			key, err := entityDatastoreKey(doc.Namespace, doc.Kind, doc.ID, doc.Parent)
+			if err != nil {
+				logError(fmt.Sprintf("Invalid key for document %s: %v", doc.File, err), fields...)
+				kindSummary.Failed++
+				continue
+			}
+			var existing datastore.PropertyList
+			if err := client.Get(ctx, key, &existing); err != nil {
+				if err == datastore.ErrNoSuchEntity {
+					err = fmt.Errorf("%s does not exist, a document only updates an existing entity", doc.target())
+				}
+				logError(fmt.Sprintf("Error fetching the entity of document %s: %v", doc.File, err), fields...)
+				kindSummary.Failed++
+				continue
+			}
+			before := dsvalue.FromPropertyList(existing)
+			change = &PlannedChange{
+				Namespace: doc.Namespace,
+				Kind:      doc.Kind,
+				ID:        doc.ID,
+				Parent:    doc.Parent,
+				Action:    "updated",
+				Before:    before,
+				After:     before,
+				Decision:  decisionPending,
+			}
+		}
+
+		if merge {
+			current, _ := propertyValue(change.After, doc.propertyNames())
+			value = mergePatch(current, value)
+		}
+		after, err := withDocument(change.After, doc, value)
+		if err != nil {
+			logError(fmt.Sprintf("Document %s cannot be set on %s: %v", doc.File, doc.target(), err), fields...)
+			kindSummary.Failed++
+			continue
+		}
+		if change.Action == "updated" {
+			after = kindRules.preserveData(after, change.Before)
+		}
+		change.After = after
+		change.Document = doc.File
+		change.Diff = kindRules.diffData(change.Before, after)
+		// The kind file may have left the entity unchanged, it is counted once
+		countedUnchanged := plan.unchanged[plannedKey(doc.Namespace, doc.Kind, doc.Parent, doc.ID)]
+		switch {
+		case len(change.Diff) > 0 && fetched:
+			plan.Changes = append(plan.Changes, change)
+			if countedUnchanged {
+				kindSummary.Unchanged--
+			}
+		case len(change.Diff) == 0 && change.Action == "updated":
+			// The document leaves the entity as it is in Datastore
+			logDebug(fmt.Sprintf("Document %s is unchanged", doc.File), fields...)
+			plan.filter(func(planned *PlannedChange) bool { return planned != change })
+			if !countedUnchanged {
+				kindSummary.Unchanged++
+			}
+		}
+	}
+	return nil
+}
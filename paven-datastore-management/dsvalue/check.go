@@ -0,0 +1,124 @@
+package dsvalue
+
+import "fmt"
+
+// Problem is a value of a typed JSON document that Datastore rejects or stores differently than
+// intended
+type Problem struct {
+	Path    string // property path of the value, e.g. cta[0]
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Path == "" {
+		return p.Message
+	}
+	return p.Path + ": " + p.Message
+}
+
+// CheckDocument reports every invalid value of a typed JSON document, in the shapes accepted by
+// DecodeDocument. Unlike DecodeDocument it does not stop at the first problem, so it can list
+// everything wrong with a generated file, notably arrays nested directly inside arrays.
+func CheckDocument(document interface{}) []Problem {
+	var problems []Problem
+	message, ok := document.(map[string]interface{})
+	if !ok {
+		return append(problems, Problem{Message: fmt.Sprintf("expected a typed JSON object, got %s", describe(document))})
+	}
+	if len(message) == 1 {
+		if properties, ok := message["properties"]; ok {
+			checkProperties(properties, "", &problems)
+			return problems
+		}
+		if values, ok := message["values"]; ok {
+			checkArray(values, "", &problems)
+			return problems
+		}
+	}
+	checkValue(message, "", &problems)
+	return problems
+}
+
+func checkValue(typed interface{}, path string, problems *[]Problem) {
+	message, ok := typed.(map[string]interface{})
+	if !ok {
+		*problems = append(*problems, Problem{Path: path, Message: fmt.Sprintf("expected a typed value object, got %s", describe(typed))})
+		return
+	}
+	var fields []string
+	for _, key := range sortedNames(message) {
+		switch {
+		case isValueType(key):
+			fields = append(fields, key)
+		case !valueOptions[key]:
+			*problems = append(*problems, Problem{Path: path, Message: fmt.Sprintf("unknown typed value field %q", key)})
+		}
+	}
+	if len(fields) != 1 {
+		*problems = append(*problems, Problem{Path: path, Message: fmt.Sprintf("a typed value needs exactly one value field, found %d", len(fields))})
+		return
+	}
+
+	raw := message[fields[0]]
+	switch fields[0] {
+	case "entityValue":
+		entity, ok := raw.(map[string]interface{})
+		if !ok {
+			*problems = append(*problems, Problem{Path: path, Message: fmt.Sprintf("invalid entityValue %s", describe(raw))})
+			return
+		}
+		checkProperties(entity["properties"], path, problems)
+	case "arrayValue":
+		array, ok := raw.(map[string]interface{})
+		if !ok {
+			*problems = append(*problems, Problem{Path: path, Message: fmt.Sprintf("invalid arrayValue %s", describe(raw))})
+			return
+		}
+		checkArray(array["values"], path, problems)
+	default:
+		if _, err := FromTyped(message); err != nil {
+			*problems = append(*problems, Problem{Path: path, Message: err.Error()})
+		}
+	}
+}
+
+func checkProperties(properties interface{}, path string, problems *[]Problem) {
+	if properties == nil {
+		return
+	}
+	typed, ok := properties.(map[string]interface{})
+	if !ok {
+		*problems = append(*problems, Problem{Path: path, Message: fmt.Sprintf("expected a properties object, got %s", describe(properties))})
+		return
+	}
+	for _, name := range sortedNames(typed) {
+		childPath := name
+		if path != "" {
+			childPath = path + "." + name
+		}
+		checkValue(typed[name], childPath, problems)
+	}
+}
+
+func checkArray(values interface{}, path string, problems *[]Problem) {
+	if values == nil {
+		return
+	}
+	typed, ok := values.([]interface{})
+	if !ok {
+		*problems = append(*problems, Problem{Path: path, Message: fmt.Sprintf("expected an array of values, got %s", describe(values))})
+		return
+	}
+	for i, item := range typed {
+		itemPath := fmt.Sprintf("%s[%d]", path, i)
+		if nested, ok := item.([]interface{}); ok {
+			*problems = append(*problems, Problem{Path: itemPath, Message: fmt.Sprintf("the values are wrapped in another array of %d items, Datastore does not accept arrays of arrays", len(nested))})
+			continue
+		}
+		if message, ok := item.(map[string]interface{}); ok && message["arrayValue"] != nil {
+			*problems = append(*problems, Problem{Path: itemPath, Message: "an array cannot contain an array value"})
+			continue
+		}
+		checkValue(item, itemPath, problems)
+	}
+}
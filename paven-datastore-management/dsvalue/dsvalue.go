@@ -0,0 +1,599 @@
+// Package dsvalue converts Datastore values between three shapes: plain JSON as found in the kind
+// files, the typed JSON of the Datastore REST API (Value messages such as {"stringValue": "x"} and
+// {"entityValue": {"properties": {...}}}) and datastore.PropertyList.
+//
+// Values are held as Go values in between: nil, bool, int64, float64, string, time.Time, []byte,
+// *datastore.Key, datastore.GeoPoint, map[string]interface{} for embedded entities and
+// []interface{} for arrays.
+package dsvalue
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// valueTypes are the fields of a Value message that hold the value, exactly one is set
+var valueTypes = []string{
+	"nullValue", "booleanValue", "integerValue", "doubleValue", "timestampValue", "keyValue",
+	"stringValue", "blobValue", "geoPointValue", "entityValue", "arrayValue",
+}
+
+// valueOptions are the other fields of a Value message, accepted and ignored when decoding
+var valueOptions = map[string]bool{"meaning": true, "excludeFromIndexes": true}
+
+// FromJSON turns decoded plain JSON into Go values: whole numbers become int64, as Datastore
+// stores them as integers, and json.Number is parsed
+func FromJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<63 {
+			return int64(v)
+		}
+		return v
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return FromJSON(f)
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			result[key] = FromJSON(val)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, val := range v {
+			result[i] = FromJSON(val)
+		}
+		return result
+	default:
+		return v
+	}
+}
+
+// Plain turns decoded plain JSON, property lists and the values loaded from Datastore into the Go
+// values held in a data map: embedded entities become maps, whole numbers int64
+func Plain(value interface{}) interface{} {
+	return FromJSON(fromProperty(value))
+}
+
+// ToJSON turns Go values into plain JSON values: timestamps become RFC 3339 strings, blobs base64
+// strings, keys their "kind,id" path and geo points a latitude/longitude object
+func ToJSON(value interface{}) interface{} {
+	switch v := value.(type) {
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v)
+	case *datastore.Key:
+		return keyPath(v)
+	case datastore.GeoPoint:
+		return map[string]interface{}{"latitude": v.Lat, "longitude": v.Lng}
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for key, val := range v {
+			result[key] = ToJSON(val)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, val := range v {
+			result[i] = ToJSON(val)
+		}
+		return result
+	default:
+		return v
+	}
+}
+
+// FromTyped decodes one Value message of the REST API
+func FromTyped(typed interface{}) (interface{}, error) {
+	message, ok := typed.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a typed value object, got %s", describe(typed))
+	}
+	valueType := ""
+	for key := range message {
+		if valueOptions[key] {
+			continue
+		}
+		if !isValueType(key) {
+			return nil, fmt.Errorf("unknown typed value field %q", key)
+		}
+		if valueType != "" {
+			return nil, fmt.Errorf("typed value has both %s and %s", valueType, key)
+		}
+		valueType = key
+	}
+	if valueType == "" {
+		return nil, fmt.Errorf("typed value has none of %s", strings.Join(valueTypes, ", "))
+	}
+
+	raw := message[valueType]
+	switch valueType {
+	case "nullValue":
+		return nil, nil
+	case "booleanValue":
+		if b, ok := raw.(bool); ok {
+			return b, nil
+		}
+	case "integerValue":
+		// int64 is a string in the REST API, generated files often use a number
+		switch v := raw.(type) {
+		case string:
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid integerValue %q", v)
+			}
+			return n, nil
+		case float64:
+			if v == math.Trunc(v) {
+				return int64(v), nil
+			}
+		case json.Number:
+			if n, err := v.Int64(); err == nil {
+				return n, nil
+			}
+		}
+	case "doubleValue":
+		switch v := raw.(type) {
+		case float64, json.Number:
+			if f, ok := number(v); ok {
+				return f, nil
+			}
+		case string:
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid doubleValue %q", v)
+			}
+			return f, nil
+		}
+	case "timestampValue":
+		if s, ok := raw.(string); ok {
+			t, err := time.Parse(time.RFC3339Nano, s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timestampValue %q: %v", s, err)
+			}
+			return t, nil
+		}
+	case "stringValue":
+		if s, ok := raw.(string); ok {
+			return s, nil
+		}
+	case "blobValue":
+		if s, ok := raw.(string); ok {
+			b, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid blobValue: %v", err)
+			}
+			return b, nil
+		}
+	case "keyValue":
+		return keyFromTyped(raw)
+	case "geoPointValue":
+		if point, ok := raw.(map[string]interface{}); ok {
+			lat, latOK := number(point["latitude"])
+			lng, lngOK := number(point["longitude"])
+			if latOK && lngOK {
+				return datastore.GeoPoint{Lat: lat, Lng: lng}, nil
+			}
+		}
+	case "entityValue":
+		entity, ok := raw.(map[string]interface{})
+		if !ok {
+			break
+		}
+		return PropertiesFromTyped(entity["properties"])
+	case "arrayValue":
+		array, ok := raw.(map[string]interface{})
+		if !ok {
+			break
+		}
+		return ArrayFromTyped(array["values"])
+	}
+	return nil, fmt.Errorf("invalid %s %s", valueType, describe(raw))
+}
+
+// PropertiesFromTyped decodes the properties map of an entity, nil being an entity without properties
+func PropertiesFromTyped(properties interface{}) (map[string]interface{}, error) {
+	result := make(map[string]interface{})
+	if properties == nil {
+		return result, nil
+	}
+	typed, ok := properties.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a properties object, got %s", describe(properties))
+	}
+	for _, name := range sortedNames(typed) {
+		value, err := FromTyped(typed[name])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		result[name] = value
+	}
+	return result, nil
+}
+
+// ArrayFromTyped decodes the values of an array value, nil being an empty array
+func ArrayFromTyped(values interface{}) ([]interface{}, error) {
+	result := []interface{}{}
+	if values == nil {
+		return result, nil
+	}
+	typed, ok := values.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected an array of values, got %s", describe(values))
+	}
+	for i, item := range typed {
+		if _, nested := item.([]interface{}); nested {
+			return nil, fmt.Errorf("[%d]: an array cannot contain an array value", i)
+		}
+		value, err := FromTyped(item)
+		if err != nil {
+			return nil, fmt.Errorf("[%d]: %v", i, err)
+		}
+		if _, nested := value.([]interface{}); nested {
+			return nil, fmt.Errorf("[%d]: an array cannot contain an array value", i)
+		}
+		result = append(result, value)
+	}
+	return result, nil
+}
+
+// ToTyped encodes a Go value as a Value message of the REST API
+func ToTyped(value interface{}) (map[string]interface{}, error) {
+	switch v := value.(type) {
+	case nil:
+		return map[string]interface{}{"nullValue": nil}, nil
+	case bool:
+		return map[string]interface{}{"booleanValue": v}, nil
+	case int:
+		return ToTyped(int64(v))
+	case int32:
+		return ToTyped(int64(v))
+	case int64:
+		return map[string]interface{}{"integerValue": strconv.FormatInt(v, 10)}, nil
+	case float32:
+		return ToTyped(float64(v))
+	case float64:
+		return map[string]interface{}{"doubleValue": v}, nil
+	case json.Number:
+		return ToTyped(FromJSON(v))
+	case string:
+		return map[string]interface{}{"stringValue": v}, nil
+	case time.Time:
+		return map[string]interface{}{"timestampValue": v.UTC().Format(time.RFC3339Nano)}, nil
+	case []byte:
+		return map[string]interface{}{"blobValue": base64.StdEncoding.EncodeToString(v)}, nil
+	case *datastore.Key:
+		return map[string]interface{}{"keyValue": keyToTyped(v)}, nil
+	case datastore.GeoPoint:
+		return map[string]interface{}{"geoPointValue": map[string]interface{}{"latitude": v.Lat, "longitude": v.Lng}}, nil
+	case map[string]interface{}:
+		properties, err := PropertiesToTyped(v)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"entityValue": map[string]interface{}{"properties": properties}}, nil
+	case *datastore.Entity:
+		return ToTyped(FromPropertyList(v.Properties))
+	case datastore.PropertyList:
+		return ToTyped(FromPropertyList(v))
+	case []string:
+		items := make([]interface{}, len(v))
+		for i, s := range v {
+			items[i] = s
+		}
+		return ToTyped(items)
+	case []interface{}:
+		values, err := ArrayToTyped(v)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"arrayValue": map[string]interface{}{"values": values}}, nil
+	default:
+		return nil, fmt.Errorf("unsupported value type %T", v)
+	}
+}
+
+// PropertiesToTyped encodes the properties map of an entity
+func PropertiesToTyped(data map[string]interface{}) (map[string]interface{}, error) {
+	properties := make(map[string]interface{}, len(data))
+	for _, name := range sortedNames(data) {
+		typed, err := ToTyped(data[name])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		properties[name] = typed
+	}
+	return properties, nil
+}
+
+// ArrayToTyped encodes the items of an array value. Datastore rejects arrays directly inside arrays.
+func ArrayToTyped(items []interface{}) ([]interface{}, error) {
+	values := make([]interface{}, 0, len(items))
+	for i, item := range items {
+		if _, nested := item.([]interface{}); nested {
+			return nil, fmt.Errorf("[%d]: an array cannot contain an array value", i)
+		}
+		typed, err := ToTyped(item)
+		if err != nil {
+			return nil, fmt.Errorf("[%d]: %v", i, err)
+		}
+		values = append(values, typed)
+	}
+	return values, nil
+}
+
+// DecodeDocument decodes a typed JSON document as written by the utils-clean scripts: an entity
+// ({"properties": {...}}), the body of an array value ({"values": [...]}) or a single Value message
+func DecodeDocument(document interface{}) (interface{}, error) {
+	message, ok := document.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a typed JSON object, got %s", describe(document))
+	}
+	if len(message) == 1 {
+		if properties, ok := message["properties"]; ok {
+			return PropertiesFromTyped(properties)
+		}
+		if values, ok := message["values"]; ok {
+			return ArrayFromTyped(values)
+		}
+	}
+	return FromTyped(message)
+}
+
+// EncodeDocument encodes a Go value as a typed JSON document, the inverse of DecodeDocument: maps
+// become an entity, arrays the body of an array value and anything else a Value message
+func EncodeDocument(value interface{}) (map[string]interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		properties, err := PropertiesToTyped(v)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"properties": properties}, nil
+	case []interface{}:
+		values, err := ArrayToTyped(v)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"values": values}, nil
+	default:
+		return ToTyped(v)
+	}
+}
+
+// IsTypedDocument reports whether a decoded JSON document looks like typed JSON rather than plain
+// JSON, judging by its root and, for entities and arrays, their first value
+func IsTypedDocument(document interface{}) bool {
+	message, ok := document.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	if len(message) == 1 {
+		if properties, ok := message["properties"].(map[string]interface{}); ok {
+			for _, name := range sortedNames(properties) {
+				return isValueMessage(properties[name])
+			}
+			return true
+		}
+		if values, ok := message["values"].([]interface{}); ok {
+			return len(values) == 0 || isValueMessage(values[0])
+		}
+	}
+	return isValueMessage(message)
+}
+
+// ToPropertyList converts the data map of an entity to the property list saved to Datastore
+func ToPropertyList(data map[string]interface{}) (datastore.PropertyList, error) {
+	var properties datastore.PropertyList
+	for _, name := range sortedNames(data) {
+		value, err := toProperty(data[name])
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert property %s: %v", name, err)
+		}
+		properties = append(properties, datastore.Property{Name: name, Value: value})
+	}
+	return properties, nil
+}
+
+func toProperty(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		properties, err := ToPropertyList(v)
+		if err != nil {
+			return nil, err
+		}
+		return &datastore.Entity{Properties: properties}, nil
+	case []interface{}:
+		items := make([]interface{}, 0, len(v))
+		for i, item := range v {
+			if _, nested := item.([]interface{}); nested {
+				return nil, fmt.Errorf("[%d]: an array cannot contain an array value", i)
+			}
+			converted, err := toProperty(item)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, converted)
+		}
+		return items, nil
+	case int:
+		return int64(v), nil
+	case json.Number:
+		return toProperty(FromJSON(v))
+	case nil, bool, int64, float64, string, time.Time, []byte, *datastore.Key, datastore.GeoPoint:
+		return v, nil
+	default:
+		return nil, fmt.Errorf("unsupported property type: %T", v)
+	}
+}
+
+// FromPropertyList converts a property list loaded from Datastore to a data map
+func FromPropertyList(properties datastore.PropertyList) map[string]interface{} {
+	data := make(map[string]interface{}, len(properties))
+	for _, property := range properties {
+		data[property.Name] = fromProperty(property.Value)
+	}
+	return data
+}
+
+func fromProperty(value interface{}) interface{} {
+	switch v := value.(type) {
+	case *datastore.Entity:
+		return FromPropertyList(v.Properties)
+	case datastore.PropertyList:
+		return FromPropertyList(v)
+	case []interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = fromProperty(item)
+		}
+		return items
+	default:
+		return v
+	}
+}
+
+// keyFromTyped decodes the key of a keyValue, its path listing the ancestors first
+func keyFromTyped(raw interface{}) (*datastore.Key, error) {
+	message, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid keyValue %s", describe(raw))
+	}
+	namespace := ""
+	if partition, ok := message["partitionId"].(map[string]interface{}); ok {
+		namespace, _ = partition["namespaceId"].(string)
+	}
+	path, _ := message["path"].([]interface{})
+	if len(path) == 0 {
+		return nil, fmt.Errorf("keyValue has an empty path")
+	}
+	var key *datastore.Key
+	for _, element := range path {
+		e, ok := element.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid keyValue path element %s", describe(element))
+		}
+		kind, _ := e["kind"].(string)
+		if name, ok := e["name"].(string); ok {
+			key = datastore.NameKey(kind, name, key)
+		} else {
+			id, err := strconv.ParseInt(fmt.Sprint(e["id"]), 10, 64)
+			if err != nil && e["id"] != nil {
+				return nil, fmt.Errorf("invalid keyValue id %v", e["id"])
+			}
+			key = datastore.IDKey(kind, id, key)
+		}
+		key.Namespace = namespace
+	}
+	return key, nil
+}
+
+func keyToTyped(key *datastore.Key) map[string]interface{} {
+	var path []interface{}
+	for k := key; k != nil; k = k.Parent {
+		element := map[string]interface{}{"kind": k.Kind}
+		if k.Name != "" {
+			element["name"] = k.Name
+		} else if k.ID != 0 {
+			element["id"] = strconv.FormatInt(k.ID, 10)
+		}
+		path = append([]interface{}{element}, path...)
+	}
+	typed := map[string]interface{}{"path": path}
+	if key.Namespace != "" {
+		typed["partitionId"] = map[string]interface{}{"namespaceId": key.Namespace}
+	}
+	return typed
+}
+
+// keyPath renders a key as its comma separated kind,id path, ancestors first
+func keyPath(key *datastore.Key) string {
+	var parts []string
+	for k := key; k != nil; k = k.Parent {
+		id := k.Name
+		if id == "" {
+			id = strconv.FormatInt(k.ID, 10)
+		}
+		parts = append([]string{k.Kind, id}, parts...)
+	}
+	return strings.Join(parts, ",")
+}
+
+func isValueType(field string) bool {
+	for _, valueType := range valueTypes {
+		if field == valueType {
+			return true
+		}
+	}
+	return false
+}
+
+// isValueMessage reports whether value is an object with exactly one value field
+func isValueMessage(value interface{}) bool {
+	message, ok := value.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	found := 0
+	for key := range message {
+		switch {
+		case isValueType(key):
+			found++
+		case !valueOptions[key]:
+			return false
+		}
+	}
+	return found == 1
+}
+
+func sortedNames(m map[string]interface{}) []string {
+	names := make([]string, 0, len(m))
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// number returns a JSON number decoded with or without UseNumber
+func number(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// describe names the JSON type of a value for error messages
+func describe(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "an array"
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
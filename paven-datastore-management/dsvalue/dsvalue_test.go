@@ -0,0 +1,210 @@
+package dsvalue
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/go-test/deep"
+)
+
+// decode parses a JSON literal the way the CLI reads files
+func decode(t *testing.T, literal string) interface{} {
+	t.Helper()
+	decoder := json.NewDecoder(strings.NewReader(literal))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		t.Fatalf("invalid test JSON: %v", err)
+	}
+	return value
+}
+
+// canonical re-encodes a value so JSON literals and encoder output compare equal
+func canonical(t *testing.T, value interface{}) interface{} {
+	t.Helper()
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		t.Fatalf("failed to marshal: %v", err)
+	}
+	var result interface{}
+	if err := json.Unmarshal(encoded, &result); err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+	return result
+}
+
+func TestArrayOfEntitiesIsFlat(t *testing.T) {
+	cta := []interface{}{
+		map[string]interface{}{"type": "button", "action": "ADD"},
+		map[string]interface{}{"type": "link", "action": "NEXT"},
+	}
+	typed, err := ToTyped(cta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := decode(t, `{"arrayValue": {"values": [
+		{"entityValue": {"properties": {"action": {"stringValue": "ADD"}, "type": {"stringValue": "button"}}}},
+		{"entityValue": {"properties": {"action": {"stringValue": "NEXT"}, "type": {"stringValue": "link"}}}}
+	]}}`)
+	if diff := deep.Equal(canonical(t, typed), canonical(t, want)); diff != nil {
+		t.Error(diff)
+	}
+	if problems := CheckDocument(typed); len(problems) > 0 {
+		t.Errorf("encoded array has problems: %v", problems)
+	}
+}
+
+func TestEncodersShareTheArrayEncoder(t *testing.T) {
+	nested := []interface{}{[]interface{}{"a"}}
+	if _, err := ToTyped(nested); err == nil {
+		t.Error("ToTyped accepted an array of arrays")
+	}
+	if _, err := EncodeDocument(nested); err == nil {
+		t.Error("EncodeDocument accepted an array of arrays")
+	}
+	if _, err := PropertiesToTyped(map[string]interface{}{"steps": nested}); err == nil {
+		t.Error("PropertiesToTyped accepted an array of arrays")
+	}
+	if _, err := ToPropertyList(map[string]interface{}{"steps": nested}); err == nil {
+		t.Error("ToPropertyList accepted an array of arrays")
+	}
+}
+
+func TestScalarEncoding(t *testing.T) {
+	at := time.Date(2024, 5, 21, 19, 33, 27, 964000000, time.UTC)
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{nil, `{"nullValue": null}`},
+		{true, `{"booleanValue": true}`},
+		// int64 values are strings in the REST API
+		{int64(1716320007964), `{"integerValue": "1716320007964"}`},
+		{1.5, `{"doubleValue": 1.5}`},
+		{"#FFFFFF", `{"stringValue": "#FFFFFF"}`},
+		{at, `{"timestampValue": "2024-05-21T19:33:27.964Z"}`},
+		{[]byte("hi"), `{"blobValue": "aGk="}`},
+		{datastore.GeoPoint{Lat: 40.4, Lng: -3.7}, `{"geoPointValue": {"latitude": 40.4, "longitude": -3.7}}`},
+		{datastore.NameKey("goals", "G_BUYCAR", nil), `{"keyValue": {"path": [{"kind": "goals", "name": "G_BUYCAR"}]}}`},
+		{[]interface{}{}, `{"arrayValue": {"values": []}}`},
+	}
+	for _, test := range tests {
+		typed, err := ToTyped(test.value)
+		if err != nil {
+			t.Errorf("ToTyped(%v): %v", test.value, err)
+			continue
+		}
+		if diff := deep.Equal(canonical(t, typed), canonical(t, decode(t, test.want))); diff != nil {
+			t.Errorf("ToTyped(%v): %v", test.value, diff)
+		}
+		back, err := FromTyped(decode(t, test.want))
+		if err != nil {
+			t.Errorf("FromTyped(%s): %v", test.want, err)
+			continue
+		}
+		if diff := deep.Equal(back, test.value); diff != nil {
+			t.Errorf("FromTyped(%s): %v", test.want, diff)
+		}
+	}
+}
+
+func TestDocumentRoundTrip(t *testing.T) {
+	plain := FromJSON(decode(t, `{
+		"journeyId": "journey_paven_101",
+		"order": 3,
+		"weight": 0.25,
+		"isActive": true,
+		"steps": [{"type": "article", "canSkip": false}, {"type": "video", "tags": ["a", "b"]}],
+		"images": {"mobile": {"url": "https://example.com/a.png"}}
+	}`))
+	typed, err := EncodeDocument(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems := CheckDocument(canonical(t, typed)); len(problems) > 0 {
+		t.Errorf("encoded document has problems: %v", problems)
+	}
+	if !IsTypedDocument(canonical(t, typed)) || IsTypedDocument(canonical(t, plain)) {
+		t.Error("IsTypedDocument does not tell typed and plain JSON apart")
+	}
+	back, err := DecodeDocument(canonical(t, typed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(back, plain); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestPropertyListRoundTrip(t *testing.T) {
+	data := map[string]interface{}{
+		"title": "journey_p101_title",
+		"order": int64(1),
+		"cta":   []interface{}{map[string]interface{}{"action": "ADD"}},
+	}
+	properties, err := ToPropertyList(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if properties[0].Name != "cta" || properties[2].Name != "title" {
+		t.Errorf("properties are not sorted by name: %v", properties)
+	}
+	items, ok := properties[0].Value.([]interface{})
+	if !ok || len(items) != 1 {
+		t.Fatalf("cta is not a flat array: %#v", properties[0].Value)
+	}
+	if _, ok := items[0].(*datastore.Entity); !ok {
+		t.Errorf("cta item is %T, want *datastore.Entity", items[0])
+	}
+	if diff := deep.Equal(FromPropertyList(properties), data); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestCheckDocumentFindsNestedArrays(t *testing.T) {
+	// The shape written by getArrayEntity and getCTAArrayEntity before the fix
+	document := decode(t, `{"properties": {
+		"journeyId": {"stringValue": "journey_paven_101"},
+		"cta": {"arrayValue": {"values": [[
+			{"entityValue": {"properties": {"action": {"stringValue": "ADD"}}}}
+		]]}},
+		"tags": {"arrayValue": {"values": [{"arrayValue": {"values": []}}]}},
+		"order": {"integerValue": "x"}
+	}}`)
+	var got []string
+	for _, problem := range CheckDocument(document) {
+		got = append(got, problem.Path)
+	}
+	if diff := deep.Equal(got, []string{"cta[0]", "order", "tags[0]"}); diff != nil {
+		t.Errorf("problem paths: %v", diff)
+	}
+	if _, err := DecodeDocument(document); err == nil {
+		t.Error("DecodeDocument accepted an array of arrays")
+	}
+}
+
+func TestPlainMatchesPropertyListAndJSON(t *testing.T) {
+	loaded := datastore.PropertyList{
+		{Name: "order", Value: int64(2)},
+		{Name: "config", Value: &datastore.Entity{Properties: datastore.PropertyList{{Name: "ratio", Value: 0.5}}}},
+		{Name: "steps", Value: []interface{}{&datastore.Entity{Properties: datastore.PropertyList{{Name: "page", Value: "p1"}}}}},
+	}
+	fromFile := decode(t, `{"order": 2, "config": {"ratio": 0.5}, "steps": [{"page": "p1"}]}`)
+	want := map[string]interface{}{
+		"order":  int64(2),
+		"config": map[string]interface{}{"ratio": 0.5},
+		"steps":  []interface{}{map[string]interface{}{"page": "p1"}},
+	}
+	if diff := deep.Equal(Plain(loaded), want); diff != nil {
+		t.Errorf("property list: %v", diff)
+	}
+	if diff := deep.Equal(Plain(fromFile), want); diff != nil {
+		t.Errorf("plain JSON: %v", diff)
+	}
+	if diff := deep.Equal(Plain(float64(3)), int64(3)); diff != nil {
+		t.Errorf("whole number: %v", diff)
+	}
+}
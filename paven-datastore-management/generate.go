@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// generateOptions are the settings shared by the generators, which turn the authoring files of
+// utils-clean into entities written to the changes directory
+type generateOptions struct {
+	SourceDir string            // utils-clean checkout holding the authoring files
+	Inputs    map[string]string // authoring files by input name, relative to SourceDir, {env} is replaced by Env
+	Kind      string            // kind of the generated entities
+	EntityID  string            // ID of the entity written by generators of a single entity, e.g. the tenant
+	Env       string            // environment of the authoring files, e.g. prod for journeys-prod.json
+	Namespace string            // namespace of the generated entities
+	OutputDir string            // downloaded entities, used to keep generated timestamps stable
+	Dir       string            // changes directory the entities are written to
+}
+
+// input returns the path of the named authoring file
+func (opts generateOptions) input(name string) string {
+	file := strings.ReplaceAll(opts.Inputs[name], "{env}", opts.Env)
+	if filepath.IsAbs(file) {
+		return file
+	}
+	return filepath.Join(opts.SourceDir, filepath.FromSlash(file))
+}
+
+// generator turns authoring files into entities of one kind, and reverse turns the downloaded
+// entities back into the content of each input. The inputs, kind and entity ID are defaults that
+// the generators manifest can override.
+type generator struct {
+	inputs   map[string]string
+	kind     string
+	entityID string
+	build    func(opts generateOptions, summary *RunSummary) ([]OutputEntity, error)
+	reverse  func(opts generateOptions) (map[string]interface{}, error)
+}
+
+// generators is the registry of the generate action, by name
+var generators = map[string]generator{
+	"journeys": {
+		inputs:   map[string]string{"journeys": "journeys/detail/journeys-{env}.json", "steps": "journeys/detail/journey-steps-{env}.json"},
+		kind:     "journeys",
+		entityID: "config",
+		build:    generateJourneys,
+		reverse:  reverseJourneys,
+	},
+	"journeys-config": {
+		inputs:   map[string]string{"config": "journeys/config/journeysConfig.json"},
+		kind:     "journeys",
+		entityID: "config",
+		build:    generateJourneysConfig,
+		reverse:  reverseJourneysConfig,
+	},
+	"themes": {
+		inputs:   map[string]string{"themes": "journeys/themes/themeList.json"},
+		kind:     "journeys",
+		entityID: "config",
+		build:    generateThemes,
+		reverse:  reverseThemes,
+	},
+	"tenant": {
+		inputs:  map[string]string{"tenant": "tenant/tenant.json"},
+		kind:    "tenant",
+		build:   generateTenant,
+		reverse: reverseTenant,
+	},
+}
+
+// generatorNames returns the registered generator names, sorted
+func generatorNames() []string {
+	return sortedKeys(generators)
+}
+
+// GeneratorConfig is an entry of the generators manifest run by generate all. Empty fields keep
+// the defaults of the registered generator or the command line flags.
+type GeneratorConfig struct {
+	Name      string            `yaml:"name"`   // registered generator, e.g. journeys
+	Inputs    map[string]string `yaml:"inputs"` // authoring files by input name, relative to -sourceDir
+	Env       string            `yaml:"env"`
+	Namespace string            `yaml:"namespace"`
+	Kind      string            `yaml:"kind"`
+	ID        string            `yaml:"id"` // entity the generator writes or sets a property on
+}
+
+// generatorEntries returns the manifest entries of the named generator, or a single entry with
+// its defaults when the manifest has none
+func generatorEntries(config Config, name string) []GeneratorConfig {
+	var entries []GeneratorConfig
+	for _, entry := range config.Generators {
+		if entry.Name == name {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) == 0 {
+		entries = append(entries, GeneratorConfig{Name: name})
+	}
+	return entries
+}
+
+// generatorOptions resolves the registered generator of a manifest entry and its options, with
+// base holding the flag defaults
+func generatorOptions(entry GeneratorConfig, base generateOptions) (generator, generateOptions, error) {
+	gen, ok := generators[entry.Name]
+	if !ok {
+		return gen, base, fmt.Errorf("unknown generator %q, expected one of %s", entry.Name, strings.Join(generatorNames(), ", "))
+	}
+	opts := base
+	opts.Kind = gen.kind
+	if gen.entityID != "" {
+		opts.EntityID = gen.entityID
+	}
+	opts.Inputs = make(map[string]string)
+	for name, file := range gen.inputs {
+		opts.Inputs[name] = file
+	}
+	for name, file := range entry.Inputs {
+		if _, ok := gen.inputs[name]; !ok {
+			return gen, base, fmt.Errorf("generator %s has no input %q", entry.Name, name)
+		}
+		opts.Inputs[name] = file
+	}
+	for _, override := range []struct {
+		value  string
+		target *string
+	}{{entry.Env, &opts.Env}, {entry.Namespace, &opts.Namespace}, {entry.Kind, &opts.Kind}, {entry.ID, &opts.EntityID}} {
+		if override.value != "" {
+			*override.target = override.value
+		}
+	}
+	return gen, opts, nil
+}
+
+// runGenerator runs a manifest entry with base holding the flag defaults, writes the generated
+// entities to the changes directory and returns the keys of those that were created or changed
+func runGenerator(entry GeneratorConfig, base generateOptions, summary *RunSummary) ([]string, error) {
+	gen, opts, err := generatorOptions(entry, base)
+	if err != nil {
+		return nil, err
+	}
+	entities, err := gen.build(opts, summary)
+	if err != nil {
+		return nil, err
+	}
+	return writeGeneratedEntities(opts, entities, summary)
+}
+
+// generateAll runs every entry of the generators manifest in order, so entries setting properties
+// of the same entity build on each other, and logs which outputs changed. It keeps going after a
+// failing entry and returns how many failed.
+func generateAll(config Config, base generateOptions, summary *RunSummary) int {
+	failed := 0
+	for _, entry := range config.Generators {
+		label := entry.Name
+		if entry.ID != "" {
+			label += " " + entry.ID
+		}
+		changed, err := runGenerator(entry, base, summary)
+		if err != nil {
+			failed++
+			logError(fmt.Sprintf("Generator %s failed: %v", label, err), "generator", entry.Name)
+			continue
+		}
+		if len(changed) == 0 {
+			logInfo(fmt.Sprintf("Generator %s: outputs unchanged", label), "generator", entry.Name)
+			continue
+		}
+		logInfo(fmt.Sprintf("Generator %s changed %s", label, strings.Join(changed, ", ")), "generator", entry.Name)
+	}
+	return failed
+}
+
+// readSourceJSON decodes an authoring file of the source directory
+func readSourceJSON(path string, value interface{}) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	if err := json.Unmarshal(content, value); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	return nil
+}
+
+// existingEntity returns the entity with the given ID from the changes directory or, when it is not
+// there yet, from the download, or nil when neither has it
+func existingEntity(opts generateOptions, kind, parent, id string) (*OutputEntity, error) {
+	for _, dir := range []string{opts.Dir, opts.OutputDir} {
+		if dir == "" {
+			continue
+		}
+		entities, err := readKindFile(filepath.Join(dir, opts.Namespace, kind+".json"))
+		if err != nil {
+			return nil, err
+		}
+		for i := range entities {
+			if entities[i].ID == id && entities[i].Parent == parent {
+				return &entities[i], nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// withProperty returns a copy of the existing entity kind/id, from the changes directory or the
+// download, with one property replaced, so a generator producing a single property of a larger
+// entity leaves the rest of it untouched
+func withProperty(opts generateOptions, kind, id, property string, value interface{}) (OutputEntity, error) {
+	existing, err := existingEntity(opts, kind, "", id)
+	if err != nil {
+		return OutputEntity{}, err
+	}
+	if existing == nil {
+		return OutputEntity{}, fmt.Errorf("no %s/%s entity in %s or %s to set %s on, download the %s kind first", kind, id, opts.Dir, opts.OutputDir, property, kind)
+	}
+	data := make(map[string]interface{})
+	if existing.Data != nil {
+		data = copyValue(existing.Data).(map[string]interface{})
+	}
+	data[property] = value
+	return OutputEntity{ID: existing.ID, Parent: existing.Parent, Data: data}, nil
+}
+
+// stableTimestamp keeps the timestamp property of the existing data when nothing else changed,
+// so regenerating unchanged sources does not produce a difference, and stamps the current time
+// in milliseconds otherwise
+func stableTimestamp(data map[string]interface{}, property string, existing map[string]interface{}) {
+	if previous, ok := existing[property]; ok {
+		candidate := copyValue(data).(map[string]interface{})
+		candidate[property] = previous
+		if canonicalJSON(candidate) == canonicalJSON(existing) {
+			data[property] = previous
+			return
+		}
+	}
+	data[property] = strconv.FormatInt(time.Now().UnixMilli(), 10)
+}
+
+// writeGeneratedEntities merges the entities into the kind file of the changes directory, replacing
+// the entities with the same key and keeping the others, and records in summary how many were
+// created, updated or left unchanged. It returns the keys of the created and updated entities.
+func writeGeneratedEntities(opts generateOptions, entities []OutputEntity, summary *RunSummary) ([]string, error) {
+	kind := opts.Kind
+	kindSummary := summary.Kind(opts.Namespace, kind)
+	filePath := filepath.Join(opts.Dir, opts.Namespace, kind+".json")
+	existing, err := readKindFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var changed []string
+	index := make(map[string]int)
+	for i, entity := range existing {
+		index[entityKeyString(entity)] = i
+	}
+	for _, entity := range entities {
+		key := entityKeyString(entity)
+		fields := []any{"namespace", opts.Namespace, "kind", kind, "key", key}
+		i, found := index[key]
+		switch {
+		case !found:
+			existing = append(existing, entity)
+			index[key] = len(existing) - 1
+			kindSummary.Created++
+			changed = append(changed, key)
+			logInfo(fmt.Sprintf("Generated new entity %s", key), fields...)
+		case canonicalJSON(existing[i].Data) == canonicalJSON(entity.Data):
+			kindSummary.Unchanged++
+			logDebug(fmt.Sprintf("Generated entity %s is unchanged", key), fields...)
+		default:
+			existing[i] = entity
+			kindSummary.Updated++
+			changed = append(changed, key)
+			logInfo(fmt.Sprintf("Generated entity %s changed", key), fields...)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		return nil, fmt.Errorf("failed to create namespace directory %s: %v", filepath.Dir(filePath), err)
+	}
+	jsonData, err := json.MarshalIndent(existing, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal entities for kind %s to JSON: %v", kind, err)
+	}
+	if err := ioutil.WriteFile(filePath, jsonData, 0644); err != nil {
+		return nil, fmt.Errorf("failed to write JSON file for kind %s: %v", kind, err)
+	}
+	return changed, nil
+}
+
+// reportSourceProblems logs the validation problems of an authoring file and counts them as
+// failures of the generated kind, returning an error when there is any
+func reportSourceProblems(opts generateOptions, file string, problems []string, summary *RunSummary) error {
+	for _, problem := range problems {
+		logError(fmt.Sprintf("%s: %s", file, problem), "file", file)
+	}
+	if len(problems) > 0 {
+		summary.Kind(opts.Namespace, opts.Kind).Failed += len(problems)
+		return fmt.Errorf("%d problems in %s", len(problems), file)
+	}
+	return nil
+}
+
+// textSource is a translation key with its font colour, the i18n entries of the authoring files
+type textSource struct {
+	Text      string `json:"text,omitempty"`
+	FontColor string `json:"fontColor,omitempty"`
+}
+
+// ctaSource is a call-to-action button of the authoring files
+type ctaSource struct {
+	Type                    string `json:"type,omitempty"`
+	Action                  string `json:"action,omitempty"`
+	BackgroundColor         string `json:"backgroundColor,omitempty"`
+	FontColor               string `json:"fontColor,omitempty"`
+	Text                    string `json:"text,omitempty"`
+	TextDesktop             string `json:"textDesktop,omitempty"`
+	TextTablet              string `json:"textTablet,omitempty"`
+	URL                     string `json:"url,omitempty"`
+	DisabledBackgroundColor string `json:"disabledBackgroundColor,omitempty"`
+	DisabledFontColor       string `json:"disabledFontColor,omitempty"`
+}
+
+// setString sets a string property, leaving empty values out as the utils.js builders do
+func setString(data map[string]interface{}, name, value string) {
+	if value != "" {
+		data[name] = value
+	}
+}
+
+// textEntities builds the i18n entity of the authoring format, one text entity per entry
+func textEntities(source map[string]textSource) map[string]interface{} {
+	i18n := make(map[string]interface{})
+	for name, text := range source {
+		entity := make(map[string]interface{})
+		setString(entity, "text", text.Text)
+		setString(entity, "fontColor", text.FontColor)
+		i18n[name] = entity
+	}
+	return i18n
+}
+
+// platformImages builds an entity of image URLs per platform (web, tablet, mobile), nil when none is set
+func platformImages(source map[string]string) map[string]interface{} {
+	images := make(map[string]interface{})
+	for platform, url := range source {
+		setString(images, platform, url)
+	}
+	if len(images) == 0 {
+		return nil
+	}
+	return images
+}
+
+// ctaEntities builds the call-to-action buttons of the authoring format
+func ctaEntities(source []ctaSource) []interface{} {
+	ctas := make([]interface{}, 0, len(source))
+	for _, cta := range source {
+		entity := make(map[string]interface{})
+		setString(entity, "type", cta.Type)
+		setString(entity, "action", cta.Action)
+		setString(entity, "backgroundColor", cta.BackgroundColor)
+		setString(entity, "fontColor", cta.FontColor)
+		setString(entity, "text", cta.Text)
+		setString(entity, "textDesktop", cta.TextDesktop)
+		setString(entity, "textTablet", cta.TextTablet)
+		setString(entity, "url", cta.URL)
+		setString(entity, "disabledBackgroundColor", cta.DisabledBackgroundColor)
+		setString(entity, "disabledFontColor", cta.DisabledFontColor)
+		ctas = append(ctas, entity)
+	}
+	return ctas
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestStableTimestamp(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     map[string]interface{}
+		existing map[string]interface{}
+		keep     bool
+	}{
+		{"new entity", map[string]interface{}{"title": "a"}, nil, false},
+		{"unchanged", map[string]interface{}{"title": "a", "order": int64(1)},
+			map[string]interface{}{"title": "a", "order": float64(1), "date": "1700000000000"}, true},
+		{"unchanged nested", map[string]interface{}{"steps": []interface{}{map[string]interface{}{"page": "p"}}},
+			map[string]interface{}{"steps": []interface{}{map[string]interface{}{"page": "p"}}, "date": "1700000000000"}, true},
+		{"changed", map[string]interface{}{"title": "b"}, map[string]interface{}{"title": "a", "date": "1700000000000"}, false},
+		{"property added", map[string]interface{}{"title": "a", "order": int64(1)}, map[string]interface{}{"title": "a", "date": "1700000000000"}, false},
+		{"no previous timestamp", map[string]interface{}{"title": "a"}, map[string]interface{}{"title": "a"}, false},
+	}
+	for _, test := range tests {
+		start := time.Now().UnixMilli()
+		stableTimestamp(test.data, "date", test.existing)
+		got, ok := test.data["date"].(string)
+		if !ok {
+			t.Fatalf("%s: date is %T, want a string", test.name, test.data["date"])
+		}
+		if test.keep {
+			if got != test.existing["date"] {
+				t.Errorf("%s: date %s, want the previous %s", test.name, got, test.existing["date"])
+			}
+			continue
+		}
+		stamp, err := strconv.ParseInt(got, 10, 64)
+		if err != nil || stamp < start || stamp > time.Now().UnixMilli() {
+			t.Errorf("%s: date %s is not the current time in milliseconds", test.name, got)
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// The journeys kind holds one entity per journey, keyed by its journeyId, and the journeys
+// configuration entity (EntityID, config by default) whose config, themes and journeysList
+// properties are generated separately
+
+// journeySource is a journey of journeys-<env>.json
+type journeySource struct {
+	JourneyID   string                       `json:"journeyId,omitempty"`
+	ShareAlias  string                       `json:"shareAlias,omitempty"`
+	Images      map[string]map[string]string `json:"images,omitempty"`
+	Video       map[string]string            `json:"video,omitempty"`
+	I18n        map[string]textSource        `json:"i18n,omitempty"`
+	Highlighted bool                         `json:"highlighted"`
+	Done        bool                         `json:"done"`
+	CTA         []ctaSource                  `json:"cta,omitempty"`
+	Theme       string                       `json:"theme,omitempty"`
+}
+
+// journeyStepSource is a step of journey-steps-<env>.json, which maps every journeyId to its steps
+type journeyStepSource struct {
+	ID      string                `json:"id,omitempty"`
+	Type    string                `json:"type,omitempty"`
+	URL     string                `json:"url,omitempty"`
+	Icons   string                `json:"icons,omitempty"`
+	CanSkip bool                  `json:"canSkip"`
+	I18n    map[string]textSource `json:"i18n,omitempty"`
+}
+
+// generateJourneys builds the journey entities from the journeys and steps inputs
+// (journeys-<env>.json and journey-steps-<env>.json), as JourneyDetailToDatastore.js does, and sets
+// the journeysList of the journeys configuration, which must be in the changes directory or the
+// download. Every journey must have steps.
+func generateJourneys(opts generateOptions, summary *RunSummary) ([]OutputEntity, error) {
+	journeysFile, stepsFile := opts.input("journeys"), opts.input("steps")
+	var journeys []journeySource
+	if err := readSourceJSON(journeysFile, &journeys); err != nil {
+		return nil, err
+	}
+	var steps map[string][]journeyStepSource
+	if err := readSourceJSON(stepsFile, &steps); err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	seen := make(map[string]bool)
+	for i, journey := range journeys {
+		switch {
+		case journey.JourneyID == "":
+			problems = append(problems, fmt.Sprintf("journey %d has no journeyId", i))
+		case seen[journey.JourneyID]:
+			problems = append(problems, fmt.Sprintf("journey %s is listed twice", journey.JourneyID))
+		case len(steps[journey.JourneyID]) == 0:
+			problems = append(problems, fmt.Sprintf("journey %s has no steps in %s", journey.JourneyID, filepath.Base(stepsFile)))
+		}
+		seen[journey.JourneyID] = true
+	}
+	for _, journeyID := range sortedKeys(steps) {
+		if !seen[journeyID] {
+			logWarn(fmt.Sprintf("Steps of %s are not used, no journey has that journeyId", journeyID), "journey", journeyID)
+		}
+	}
+	if err := reportSourceProblems(opts, filepath.Base(journeysFile), problems, summary); err != nil {
+		return nil, err
+	}
+
+	var entities []OutputEntity
+	var journeysList []interface{}
+	for _, journey := range journeys {
+		data := journeyData(journey, steps[journey.JourneyID])
+		existing, err := existingEntity(opts, opts.Kind, "", journey.JourneyID)
+		if err != nil {
+			return nil, err
+		}
+		var existingData map[string]interface{}
+		if existing != nil {
+			existingData = existing.Data
+		}
+		stableTimestamp(data, "date", existingData)
+		entities = append(entities, OutputEntity{ID: journey.JourneyID, Data: data})
+		journeysList = append(journeysList, journey.JourneyID)
+	}
+
+	// Every generated journey must be listed, or the apps never show it
+	config, err := withProperty(opts, opts.Kind, opts.EntityID, "journeysList", journeysList)
+	if err != nil {
+		return nil, fmt.Errorf("journeysList not generated: %v", err)
+	}
+	return append(entities, config), nil
+}
+
+// journeyData builds the data of a journey entity, without its generation date
+func journeyData(journey journeySource, steps []journeyStepSource) map[string]interface{} {
+	data := map[string]interface{}{
+		"journeyId":   journey.JourneyID,
+		"i18n":        textEntities(journey.I18n),
+		"highlighted": journey.Highlighted,
+		"done":        journey.Done,
+		"cta":         ctaEntities(journey.CTA),
+		"theme":       journey.Theme,
+	}
+	if journey.Theme == "" {
+		data["theme"] = "default"
+	}
+	setString(data, "shareAlias", journey.ShareAlias)
+
+	images := make(map[string]interface{})
+	for name, platforms := range journey.Images {
+		if values := platformImages(platforms); values != nil {
+			images[name] = values
+		}
+	}
+	if len(images) > 0 {
+		data["images"] = images
+	}
+	if video := platformImages(journey.Video); video != nil {
+		data["video"] = video
+	}
+
+	stepEntities := make([]interface{}, 0, len(steps))
+	for _, step := range steps {
+		entity := map[string]interface{}{
+			"i18n":    textEntities(step.I18n),
+			"canSkip": step.CanSkip,
+		}
+		setString(entity, "icons", step.Icons)
+		setString(entity, "url", step.URL)
+		setString(entity, "type", step.Type)
+		setString(entity, "id", step.ID)
+		stepEntities = append(stepEntities, entity)
+	}
+	data["steps"] = stepEntities
+	return data
+}
+
+// reverseJourneys rebuilds journeys-<env>.json and journey-steps-<env>.json from the downloaded
+// journey entities, in the order of the journeysList of the configuration and then by journeyId
+func reverseJourneys(opts generateOptions) (map[string]interface{}, error) {
+	entities, err := readKindFile(filepath.Join(opts.OutputDir, opts.Namespace, opts.Kind+".json"))
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]OutputEntity)
+	for _, entity := range entities {
+		if entity.Parent == "" && entity.ID != opts.EntityID {
+			byID[entity.ID] = entity
+		}
+	}
+	if len(byID) == 0 {
+		return nil, fmt.Errorf("no journeys in %s, download the %s kind first", opts.OutputDir, opts.Kind)
+	}
+
+	var order []string
+	seen := make(map[string]bool)
+	config, err := existingEntity(generateOptions{Namespace: opts.Namespace, OutputDir: opts.OutputDir}, opts.Kind, "", opts.EntityID)
+	if err != nil {
+		return nil, err
+	}
+	if config != nil {
+		list, _ := config.Data["journeysList"].([]interface{})
+		for _, item := range list {
+			id, _ := item.(string)
+			if _, ok := byID[id]; ok && !seen[id] {
+				order = append(order, id)
+				seen[id] = true
+			}
+		}
+	}
+	for _, id := range sortedKeys(byID) {
+		if !seen[id] {
+			order = append(order, id)
+		}
+	}
+
+	journeys := make([]journeySource, 0, len(order))
+	steps := make(map[string][]journeyStepSource)
+	for _, id := range order {
+		var journey journeySource
+		if err := remarshal(byID[id].Data, &journey); err != nil {
+			return nil, fmt.Errorf("journey %s does not have the authoring format: %v", id, err)
+		}
+		if journey.JourneyID == "" {
+			journey.JourneyID = id
+		}
+		var journeySteps []journeyStepSource
+		if err := remarshal(byID[id].Data["steps"], &journeySteps); err != nil {
+			return nil, fmt.Errorf("steps of journey %s do not have the authoring format: %v", id, err)
+		}
+		journeys = append(journeys, journey)
+		steps[journey.JourneyID] = journeySteps
+	}
+	return map[string]interface{}{"journeys": journeys, "steps": steps}, nil
+}
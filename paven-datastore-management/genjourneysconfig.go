@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// requiredThemeColors are the colours every journey theme must define
+var requiredThemeColors = []string{"background", "cardOverlay", "previewOverlay", "finishedBackground", "hintBackground", "path", "highlightedStep"}
+
+// journeysConfigSource is journeys/config/journeysConfig.json
+type journeysConfigSource struct {
+	I18n   map[string]textSource `json:"i18n,omitempty"`
+	Colors struct {
+		Background string `json:"background,omitempty"`
+	} `json:"colors"`
+	CTA []ctaSource `json:"cta,omitempty"`
+}
+
+// generateJourneysConfig sets the config property of the journeys configuration from
+// the config input (journeysConfig.json), as JourneysConfigToDatastore.js does
+func generateJourneysConfig(opts generateOptions, summary *RunSummary) ([]OutputEntity, error) {
+	file := opts.input("config")
+	var source journeysConfigSource
+	if err := readSourceJSON(file, &source); err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	for _, name := range []string{"title", "description", "inProgress", "completed"} {
+		if source.I18n[name].Text == "" {
+			problems = append(problems, fmt.Sprintf("i18n.%s has no text", name))
+		}
+	}
+	if source.Colors.Background != "" && !hexColor.MatchString(source.Colors.Background) {
+		problems = append(problems, fmt.Sprintf("colors.background %q is not a #RRGGBB or #RRGGBBAA colour", source.Colors.Background))
+	}
+	if err := reportSourceProblems(opts, filepath.Base(file), problems, summary); err != nil {
+		return nil, err
+	}
+
+	config := map[string]interface{}{
+		"i18n":   textEntities(source.I18n),
+		"colors": map[string]interface{}{},
+		"cta":    ctaEntities(source.CTA),
+	}
+	setString(config["colors"].(map[string]interface{}), "background", source.Colors.Background)
+
+	entity, err := withProperty(opts, opts.Kind, opts.EntityID, "config", config)
+	if err != nil {
+		return nil, err
+	}
+	return []OutputEntity{entity}, nil
+}
+
+// generateThemes sets the themes property of the journeys configuration from the themes input
+// (themeList.json), as ThemeToDatasotre.js does. Every theme must define the required colours as
+// #RRGGBB or #RRGGBBAA values.
+func generateThemes(opts generateOptions, summary *RunSummary) ([]OutputEntity, error) {
+	file := opts.input("themes")
+	var source map[string]map[string]string
+	if err := readSourceJSON(file, &source); err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	if _, ok := source["default"]; !ok {
+		problems = append(problems, "there is no default theme, journeys without a theme use it")
+	}
+	themes := make(map[string]interface{})
+	for _, name := range sortedKeys(source) {
+		var missing []string
+		for _, color := range requiredThemeColors {
+			if source[name][color] == "" {
+				missing = append(missing, color)
+			}
+		}
+		if len(missing) > 0 {
+			problems = append(problems, fmt.Sprintf("theme %s has no %s", name, strings.Join(missing, ", ")))
+		}
+		colors := make(map[string]interface{})
+		for _, color := range sortedKeys(source[name]) {
+			value := source[name][color]
+			if !hexColor.MatchString(value) {
+				problems = append(problems, fmt.Sprintf("theme %s: %s %q is not a #RRGGBB or #RRGGBBAA colour", name, color, value))
+			}
+			setString(colors, color, value)
+		}
+		themes[name] = colors
+	}
+	if err := reportSourceProblems(opts, filepath.Base(file), problems, summary); err != nil {
+		return nil, err
+	}
+
+	entity, err := withProperty(opts, opts.Kind, opts.EntityID, "themes", themes)
+	if err != nil {
+		return nil, err
+	}
+	return []OutputEntity{entity}, nil
+}
+
+// reverseJourneysConfig rebuilds journeysConfig.json from the config property of the downloaded
+// journeys configuration
+func reverseJourneysConfig(opts generateOptions) (map[string]interface{}, error) {
+	var source journeysConfigSource
+	if err := downloadedProperty(opts, "config", &source); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"config": source}, nil
+}
+
+// reverseThemes rebuilds themeList.json from the themes property of the downloaded journeys
+// configuration
+func reverseThemes(opts generateOptions) (map[string]interface{}, error) {
+	var source map[string]map[string]string
+	if err := downloadedProperty(opts, "themes", &source); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{"themes": source}, nil
+}
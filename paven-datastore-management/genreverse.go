@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// remarshal converts a JSON-like value, such as entity data, into an authoring type
+func remarshal(value, target interface{}) error {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, target)
+}
+
+// plainJSON converts an authoring value into JSON-like maps and slices, dropping what the
+// authoring type does not hold, so it can be compared with propertyDiff
+func plainJSON(value interface{}) (interface{}, error) {
+	var plain interface{}
+	err := remarshal(value, &plain)
+	return plain, err
+}
+
+// downloadedProperty decodes one property of the downloaded entity opts.Kind/opts.EntityID into
+// the authoring type of a generator setting that property
+func downloadedProperty(opts generateOptions, property string, target interface{}) error {
+	if opts.EntityID == "" {
+		return fmt.Errorf("the %s entity to reverse is not set, pass its ID with -entityID or set id in the generators manifest", opts.Kind)
+	}
+	existing, err := existingEntity(generateOptions{Namespace: opts.Namespace, OutputDir: opts.OutputDir}, opts.Kind, "", opts.EntityID)
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		return fmt.Errorf("no %s/%s entity in %s, download the %s kind first", opts.Kind, opts.EntityID, opts.OutputDir, opts.Kind)
+	}
+	value, ok := existing.Data[property]
+	if !ok {
+		return fmt.Errorf("%s/%s has no %s property", opts.Kind, opts.EntityID, property)
+	}
+	if err := remarshal(value, target); err != nil {
+		return fmt.Errorf("%s/%s %s does not have the authoring format: %v", opts.Kind, opts.EntityID, property, err)
+	}
+	return nil
+}
+
+// writeReversed writes the authoring files reconstructed from the download by a manifest entry
+// into dir, at the paths of its inputs relative to the source directory
+func writeReversed(entry GeneratorConfig, base generateOptions, dir string) error {
+	gen, opts, err := generatorOptions(entry, base)
+	if err != nil {
+		return err
+	}
+	files, err := gen.reverse(opts)
+	if err != nil {
+		return err
+	}
+	for _, name := range sortedKeys(files) {
+		file := strings.ReplaceAll(opts.Inputs[name], "{env}", opts.Env)
+		if filepath.IsAbs(file) {
+			file = filepath.Base(file)
+		}
+		path := filepath.Join(dir, filepath.FromSlash(file))
+		if err := writeSourceJSON(path, files[name]); err != nil {
+			return err
+		}
+		logInfo(fmt.Sprintf("Reversed %s written to %s", name, path), "generator", entry.Name, "namespace", opts.Namespace, "kind", opts.Kind)
+	}
+	return nil
+}
+
+// writeSourceJSON writes an authoring file indented as the utils-clean sources are
+func writeSourceJSON(path string, value interface{}) error {
+	content, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %v", path, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create directory %s: %v", filepath.Dir(path), err)
+	}
+	if err := ioutil.WriteFile(path, append(content, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	return nil
+}
+
+// checkGeneratorDrift reverses the downloaded entities of a manifest entry and regenerates them
+// from the result. Properties that change on the way, because they were edited in a way the
+// authoring format cannot hold, are logged and count as failures of the entity. Authoring files
+// that differ from the reversed content are out of date with Datastore and count as updated.
+func checkGeneratorDrift(entry GeneratorConfig, base generateOptions, summary *RunSummary) error {
+	gen, opts, err := generatorOptions(entry, base)
+	if err != nil {
+		return err
+	}
+	opts.Dir = ""
+	kindSummary := summary.Kind(opts.Namespace, opts.Kind)
+	files, err := gen.reverse(opts)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range sortedKeys(files) {
+		path := opts.input(name)
+		current := reflect.New(reflect.TypeOf(files[name]))
+		if err := readSourceJSON(path, current.Interface()); err != nil {
+			logWarn(fmt.Sprintf("Source %s cannot be compared with Datastore: %v", name, err), "generator", entry.Name, "file", path)
+			kindSummary.Updated++
+			continue
+		}
+		before, err := plainJSON(current.Elem().Interface())
+		if err != nil {
+			return err
+		}
+		after, err := plainJSON(files[name])
+		if err != nil {
+			return err
+		}
+		diff := propertyDiff("", before, after)
+		if len(diff) == 0 {
+			logDebug(fmt.Sprintf("Source %s matches Datastore", path), "generator", entry.Name)
+			continue
+		}
+		kindSummary.Updated++
+		logWarn(fmt.Sprintf("Source %s is out of date with Datastore, run generate reverse to update it", path), "generator", entry.Name)
+		for _, line := range diff {
+			logInfo("  "+line, "file", path)
+		}
+	}
+
+	sourceDir, err := ioutil.TempDir("", "paven-reverse-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(sourceDir)
+	regenerate := opts
+	regenerate.SourceDir = sourceDir
+	regenerate.Inputs = make(map[string]string)
+	for name, value := range files {
+		regenerate.Inputs[name] = name + ".json"
+		if err := writeSourceJSON(regenerate.input(name), value); err != nil {
+			return err
+		}
+	}
+	entities, err := gen.build(regenerate, summary)
+	if err != nil {
+		return fmt.Errorf("the reversed sources do not generate: %v", err)
+	}
+
+	for _, entity := range entities {
+		key := entityKeyString(entity)
+		fields := []any{"namespace", opts.Namespace, "kind", opts.Kind, "key", key}
+		existing, err := existingEntity(opts, opts.Kind, entity.Parent, entity.ID)
+		if err != nil {
+			return err
+		}
+		if existing == nil {
+			kindSummary.Failed++
+			logError(fmt.Sprintf("Regenerating %s creates an entity that is not in Datastore", key), fields...)
+			continue
+		}
+		diff := propertyDiff("", existing.Data, entity.Data)
+		if len(diff) == 0 {
+			kindSummary.Unchanged++
+			continue
+		}
+		kindSummary.Failed++
+		logError(fmt.Sprintf("Regenerating %s from its reversed sources changes it, these edits would be lost", key), fields...)
+		for _, line := range diff {
+			logInfo("  "+line, fields...)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"paven-go/dsvalue"
+)
+
+// The tenant kind holds the common-settings configuration of every tenant, the tutorial shown
+// on the content page is its contentTutorial property
+const tenantTutorialProperty = "contentTutorial"
+
+// tenantSource is tenant/tenant.json: the content tutorial of a tenant, and the other properties
+// of its common-settings entity as plain JSON under settings
+type tenantSource struct {
+	I18n   map[string]textSource        `json:"i18n,omitempty"`
+	Images map[string]map[string]string `json:"images,omitempty"`
+	Color  struct {
+		Overlay    string `json:"overlay,omitempty"`
+		Background string `json:"background,omitempty"`
+	} `json:"color"`
+	CTA      *ctaSource             `json:"cta,omitempty"`
+	Settings map[string]interface{} `json:"settings,omitempty"`
+}
+
+// generateTenant builds the tenant entity given by -entityID or the manifest from the tenant input
+// (tenant.json): its contentTutorial, as TenantToDatastore.js does, and every other property from
+// settings. TenantToDatastore.js has no source for those, so properties of the existing tenant
+// that settings leaves out are kept as found in the changes directory or the download, with a
+// warning, instead of being removed. The added timestamp of the tutorial only changes when the
+// tutorial does.
+func generateTenant(opts generateOptions, summary *RunSummary) ([]OutputEntity, error) {
+	if opts.EntityID == "" {
+		return nil, fmt.Errorf("the tenant to generate is not set, pass its ID with -entityID or set id in the generators manifest")
+	}
+	file := opts.input("tenant")
+	var source tenantSource
+	if err := readSourceJSON(file, &source); err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	if source.CTA == nil {
+		problems = append(problems, "there is no cta")
+	}
+	if _, ok := source.Settings[tenantTutorialProperty]; ok {
+		problems = append(problems, fmt.Sprintf("settings.%s is generated from the rest of the file, remove it", tenantTutorialProperty))
+	}
+	for name, text := range source.I18n {
+		if text.Text == "" {
+			problems = append(problems, fmt.Sprintf("i18n.%s has no text", name))
+		}
+	}
+	for name, value := range map[string]string{"overlay": source.Color.Overlay, "background": source.Color.Background} {
+		if value != "" && !hexColor.MatchString(value) {
+			problems = append(problems, fmt.Sprintf("color.%s %q is not a #RRGGBB or #RRGGBBAA colour", name, value))
+		}
+	}
+	if err := reportSourceProblems(opts, filepath.Base(file), problems, summary); err != nil {
+		return nil, err
+	}
+
+	color := make(map[string]interface{})
+	setString(color, "overlay", source.Color.Overlay)
+	setString(color, "background", source.Color.Background)
+	tutorial := map[string]interface{}{
+		"i18n":  textEntities(source.I18n),
+		"color": color,
+		"cta":   ctaEntities([]ctaSource{*source.CTA})[0],
+	}
+	images := make(map[string]interface{})
+	for name, platforms := range source.Images {
+		if values := platformImages(platforms); values != nil {
+			images[name] = values
+		}
+	}
+	if len(images) > 0 {
+		tutorial["images"] = images
+	}
+
+	existing, err := existingEntity(opts, opts.Kind, "", opts.EntityID)
+	if err != nil {
+		return nil, err
+	}
+	entity := OutputEntity{ID: opts.EntityID, Data: make(map[string]interface{})}
+	data := entity.Data
+	var existingTutorial map[string]interface{}
+	if existing != nil {
+		entity.Parent = existing.Parent
+		existingTutorial, _ = existing.Data[tenantTutorialProperty].(map[string]interface{})
+		var kept []string
+		for _, name := range sortedKeys(existing.Data) {
+			if _, ok := source.Settings[name]; !ok && name != tenantTutorialProperty {
+				data[name] = copyValue(existing.Data[name])
+				kept = append(kept, name)
+			}
+		}
+		if len(kept) > 0 {
+			logWarn(fmt.Sprintf("%s has no settings for %s, keeping the values of %s/%s", filepath.Base(file), strings.Join(kept, ", "), opts.Kind, opts.EntityID),
+				"namespace", opts.Namespace, "kind", opts.Kind, "key", opts.EntityID)
+		}
+	}
+	for name, value := range source.Settings {
+		data[name] = dsvalue.Plain(value)
+	}
+	stableTimestamp(tutorial, "added", existingTutorial)
+	data[tenantTutorialProperty] = tutorial
+	return []OutputEntity{entity}, nil
+}
+
+// reverseTenant rebuilds tenant.json from the downloaded tenant: the contentTutorial, leaving out
+// its added timestamp, and the other properties as settings
+func reverseTenant(opts generateOptions) (map[string]interface{}, error) {
+	var source tenantSource
+	if err := downloadedProperty(opts, tenantTutorialProperty, &source); err != nil {
+		return nil, err
+	}
+	existing, err := existingEntity(generateOptions{Namespace: opts.Namespace, OutputDir: opts.OutputDir}, opts.Kind, "", opts.EntityID)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range existing.Data {
+		if name == tenantTutorialProperty {
+			continue
+		}
+		if source.Settings == nil {
+			source.Settings = make(map[string]interface{})
+		}
+		source.Settings[name] = value
+	}
+	return map[string]interface{}{"tenant": source}, nil
+}
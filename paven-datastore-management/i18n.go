@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Defaults of the i18n analysis
+var (
+	defaultI18nProperties = []string{
+		"text", "title", "subTitle", "description", "placeholderText", "componentTitle", "ifAddedText",
+		"tabTitle", "header", "key_title", "textDesktop", "textTablet",
+	}
+	defaultI18nKeyPattern = `^[A-Za-z0-9]+(_[A-Za-z0-9]+)+$`
+)
+
+// I18nConfig tells the i18n analysis which properties hold translation keys and where the
+// translations are. Properties whose name starts with "key" always hold keys.
+type I18nConfig struct {
+	Properties []string `yaml:"properties"`
+	KeyPattern string   `yaml:"keyPattern"`
+	// Ignore lists patterns of values that are neither keys nor text, e.g. ^# placeholders
+	Ignore []string `yaml:"ignore"`
+	// LocalesDir holds one <locale>.json file per locale with a flat key -> text object
+	LocalesDir string `yaml:"localesDir"`
+	// Kind is a translations kind with one entity per locale, the locale as ID and key -> text data
+	Kind      string `yaml:"kind"`
+	Namespace string `yaml:"namespace"`
+}
+
+// i18nReference is the first place a key is referenced from
+type i18nReference struct {
+	entity    *lintEntity
+	namespace string
+	kind      string
+	path      string
+}
+
+// i18nCoverage holds the counters of one goal in one locale
+type i18nCoverage struct {
+	referenced, missing, unused int
+}
+
+// percent is the share of referenced keys the locale translates
+func (c *i18nCoverage) percent() float64 {
+	if c.referenced == 0 {
+		return 100
+	}
+	return 100 * float64(c.referenced-c.missing) / float64(c.referenced)
+}
+
+// analyzeI18n extracts the translation keys referenced by every entity and compares them with the
+// configured locales. Malformed and missing keys are logged as errors, and the entities using them
+// counted once as failures of their kind, unused keys as warnings. It prints the coverage per
+// goal and locale and returns the number of errors.
+func analyzeI18n(config Config, data lintData, summary *RunSummary) (int, error) {
+	settings := config.I18n
+	properties := make(map[string]bool)
+	if len(settings.Properties) == 0 {
+		settings.Properties = defaultI18nProperties
+	}
+	for _, property := range settings.Properties {
+		properties[property] = true
+	}
+	if settings.KeyPattern == "" {
+		settings.KeyPattern = defaultI18nKeyPattern
+	}
+	keyPattern, err := regexp.Compile(settings.KeyPattern)
+	if err != nil {
+		return 0, fmt.Errorf("invalid i18n keyPattern: %v", err)
+	}
+	var ignore []*regexp.Regexp
+	for _, pattern := range settings.Ignore {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return 0, fmt.Errorf("invalid i18n ignore pattern %q: %v", pattern, err)
+		}
+		ignore = append(ignore, re)
+	}
+
+	locales, err := loadLocales(settings, data)
+	if err != nil {
+		return 0, err
+	}
+
+	// Referenced keys by goal, with the first place each of them is used
+	referenced := make(map[string]map[string]i18nReference)
+	// Keys referenced anywhere, and the goal using each G_<NAME>_ prefix so unused keys can be
+	// attributed to a goal even when the prefix differs from the goal ID (G_HOUSE for G_BUYHOME)
+	keyGoals := make(map[string]bool)
+	prefixGoals := make(map[string]string)
+	errors := 0
+	// Entities are counted as failed once, however many of their keys are wrong
+	failed := make(map[*lintEntity]bool)
+	fail := func(le *lintEntity, namespace, kind string) {
+		errors++
+		if !failed[le] {
+			failed[le] = true
+			summary.Kind(namespace, kind).Failed++
+		}
+	}
+	for _, namespace := range sortedKeys(data) {
+		for _, kind := range sortedKeys(data[namespace]) {
+			if kind == settings.Kind && (settings.Namespace == "" || settings.Namespace == namespace) {
+				continue
+			}
+			for _, le := range data[namespace][kind] {
+				goal := goalOf(data, namespace, le.entity)
+				for _, use := range collectI18nKeys(le.value, properties, "") {
+					if matchesAny(ignore, use.name) {
+						continue
+					}
+					key := entityKeyString(le.entity)
+					if !keyPattern.MatchString(use.name) {
+						fail(le, namespace, kind)
+						logError(fmt.Sprintf("%s: entity %s: %s: %q is not a translation key (does not match %s)", le.file, key, use.path, use.name, settings.KeyPattern),
+							entityFields(config.ProjectID, namespace, kind, key)...)
+						continue
+					}
+					if referenced[goal] == nil {
+						referenced[goal] = make(map[string]i18nReference)
+					}
+					if _, ok := referenced[goal][use.name]; !ok {
+						referenced[goal][use.name] = i18nReference{entity: le, namespace: namespace, kind: kind, path: use.path}
+					}
+					keyGoals[use.name] = true
+					if prefix := keyPrefix(use.name); prefix != "" && prefixGoals[prefix] == "" {
+						prefixGoals[prefix] = goal
+					}
+				}
+			}
+		}
+	}
+
+	if len(locales) == 0 {
+		logWarn("No locales configured (i18n.localesDir or i18n.kind), listing the referenced keys only")
+		for _, goal := range sortedKeys(referenced) {
+			for _, key := range sortedKeys(referenced[goal]) {
+				if logAsJSON {
+					logInfo("Referenced key", "goal", goalName(goal), "key", key)
+				} else {
+					fmt.Printf("%s\t%s\n", goalName(goal), key)
+				}
+			}
+		}
+		return errors, nil
+	}
+
+	coverage := make(map[[2]string]*i18nCoverage)
+	counters := func(goal, locale string) *i18nCoverage {
+		id := [2]string{goal, locale}
+		if coverage[id] == nil {
+			coverage[id] = &i18nCoverage{}
+		}
+		return coverage[id]
+	}
+	for _, locale := range sortedKeys(locales) {
+		translations := locales[locale]
+		for _, goal := range sortedKeys(referenced) {
+			for _, key := range sortedKeys(referenced[goal]) {
+				counters(goal, locale).referenced++
+				if _, ok := translations[key]; ok {
+					continue
+				}
+				ref := referenced[goal][key]
+				entityKey := entityKeyString(ref.entity.entity)
+				counters(goal, locale).missing++
+				fail(ref.entity, ref.namespace, ref.kind)
+				logError(fmt.Sprintf("%s: entity %s: %s: key %s has no %s translation", ref.entity.file, entityKey, ref.path, key, locale),
+					entityFields(config.ProjectID, ref.namespace, ref.kind, entityKey)...)
+			}
+		}
+		for _, key := range sortedKeys(translations) {
+			if keyGoals[key] {
+				continue
+			}
+			goal := prefixGoals[keyPrefix(key)]
+			if goal == "" {
+				goal = keyPrefix(key)
+			}
+			counters(goal, locale).unused++
+			logWarn(fmt.Sprintf("Key %s of locale %s is not referenced by any entity", key, locale), "locale", locale)
+		}
+	}
+
+	printI18nCoverage(coverage)
+	return errors, nil
+}
+
+// loadLocales reads the translations of every locale from the locales directory and the
+// translations kind, keyed by locale and key
+func loadLocales(settings I18nConfig, data lintData) (map[string]map[string]string, error) {
+	locales := make(map[string]map[string]string)
+	add := func(locale string, translations map[string]interface{}) {
+		if locales[locale] == nil {
+			locales[locale] = make(map[string]string)
+		}
+		for key, text := range translations {
+			locales[locale][key] = fmt.Sprint(text)
+		}
+	}
+
+	if settings.LocalesDir != "" {
+		files, err := ioutil.ReadDir(settings.LocalesDir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to read locales directory: %v", err)
+		}
+		for _, file := range files {
+			if file.IsDir() || filepath.Ext(file.Name()) != ".json" {
+				continue
+			}
+			path := filepath.Join(settings.LocalesDir, file.Name())
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read locale %s: %v", path, err)
+			}
+			var translations map[string]interface{}
+			if err := json.Unmarshal(content, &translations); err != nil {
+				return nil, fmt.Errorf("locale %s is not a flat JSON object: %v", path, err)
+			}
+			add(strings.TrimSuffix(file.Name(), ".json"), translations)
+		}
+	}
+
+	if settings.Kind != "" {
+		for _, namespace := range sortedKeys(data) {
+			if settings.Namespace != "" && namespace != settings.Namespace {
+				continue
+			}
+			for _, le := range data[namespace][settings.Kind] {
+				add(le.entity.ID, le.entity.Data)
+			}
+		}
+	}
+	return locales, nil
+}
+
+// collectI18nKeys returns the string values of the key properties anywhere in value
+func collectI18nKeys(value interface{}, properties map[string]bool, path string) []namedUse {
+	var uses []namedUse
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, key := range sortedKeys(v) {
+			childPath := joinPath(path, key)
+			if text, ok := v[key].(string); ok && (properties[key] || strings.HasPrefix(key, "key")) {
+				if text != "" {
+					uses = append(uses, namedUse{name: text, path: childPath})
+				}
+				continue
+			}
+			if nested, ok := v[key].(map[string]interface{}); ok && key == "i18nKeys" {
+				for _, name := range sortedKeys(nested) {
+					if text, ok := nested[name].(string); ok && text != "" {
+						uses = append(uses, namedUse{name: text, path: joinPath(childPath, name)})
+					}
+				}
+				continue
+			}
+			uses = append(uses, collectI18nKeys(v[key], properties, childPath)...)
+		}
+	case []interface{}:
+		for i, item := range v {
+			uses = append(uses, collectI18nKeys(item, properties, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	return uses
+}
+
+// goalOf returns the goal (the ID of a goals entity) an entity belongs to by following its
+// parents, or "" for entities shared by every goal
+func goalOf(data lintData, namespace string, entity OutputEntity) string {
+	for depth := 0; depth < 10; depth++ {
+		if entity.Parent == "" {
+			return ""
+		}
+		kind, id, _ := strings.Cut(entity.Parent, ",")
+		if kind == "goals" {
+			return id
+		}
+		found := false
+		for _, le := range data[namespace][kind] {
+			if le.entity.ID == id {
+				entity, found = le.entity, true
+				break
+			}
+		}
+		if !found {
+			return ""
+		}
+	}
+	return ""
+}
+
+// keyPrefix returns the goal prefix of a key, e.g. G_BUYCAR for G_BUYCAR_onb_page10_title
+func keyPrefix(key string) string {
+	if !strings.HasPrefix(key, "G_") {
+		return ""
+	}
+	parts := strings.SplitN(key, "_", 3)
+	if len(parts) < 3 {
+		return ""
+	}
+	return "G_" + parts[1]
+}
+
+func goalName(goal string) string {
+	if goal == "" {
+		return "(common)"
+	}
+	return goal
+}
+
+func matchesAny(patterns []*regexp.Regexp, value string) bool {
+	for _, re := range patterns {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// printI18nCoverage prints the referenced, missing and unused keys per goal and locale
+func printI18nCoverage(coverage map[[2]string]*i18nCoverage) {
+	var ids [][2]string
+	for id := range coverage {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		if ids[i][0] != ids[j][0] {
+			return ids[i][0] < ids[j][0]
+		}
+		return ids[i][1] < ids[j][1]
+	})
+
+	if logAsJSON {
+		for _, id := range ids {
+			c := coverage[id]
+			logInfo("i18n coverage", "goal", goalName(id[0]), "locale", id[1], "referenced", c.referenced,
+				"missing", c.missing, "unused", c.unused, "coverage", c.percent())
+		}
+		return
+	}
+
+	fmt.Println(colorBlue + "i18n coverage:" + colorReset)
+	fmt.Printf("%s%-20s %-8s %10s %7s %6s %8s%s\n", colorBlue, "GOAL", "LOCALE", "REFERENCED", "MISSING", "UNUSED", "COVERAGE", colorReset)
+	for _, id := range ids {
+		c := coverage[id]
+		percent := c.percent()
+		color := colorGreen
+		if c.missing > 0 {
+			color = colorRed
+		} else if c.unused > 0 {
+			color = colorYellow
+		}
+		fmt.Printf("%s%-20s %-8s %10d %7d %6d %7.1f%%%s\n", color, goalName(id[0]), id[1], c.referenced, c.missing, c.unused, percent, colorReset)
+	}
+	fmt.Println()
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"paven-go/dsvalue"
+)
+
+// ReferenceConfig declares that a property of one kind refers to entities of another kind.
+// Path is a property path in the id/parent/data shape of an entity (e.g. data.steps[*].page, or
+// parent for the parent link). The referenced entity is found by its TargetField value, or by its
+// "kind,id" key when TargetField is empty.
+type ReferenceConfig struct {
+	Kind      string `yaml:"kind"`
+	Namespace string `yaml:"namespace"` // every namespace when empty
+	Path      string `yaml:"path"`
+
+	Target          string `yaml:"target"`
+	TargetNamespace string `yaml:"targetNamespace"` // the namespace of the referencing entity when empty
+	TargetField     string `yaml:"targetField"`
+	// Scope limits the candidates to the children of the referencing entity ("children")
+	// or to the entities sharing its parent ("siblings")
+	Scope string `yaml:"scope"`
+	// Orphans reports target entities that are never referenced
+	Orphans bool `yaml:"orphans"`
+}
+
+// lintEntity is an entity of the linted data together with its id/parent/data shape
+type lintEntity struct {
+	entity OutputEntity
+	value  interface{}
+	file   string
+}
+
+// lintData holds the entities of every kind file, keyed by namespace and kind
+type lintData map[string]map[string][]*lintEntity
+
+// loadLintData reads the kind files of the directories in order. An entity of a later directory
+// replaces the one with the same key, so local changes are linted on top of the download.
+func loadLintData(dirs ...string) (lintData, error) {
+	data := make(lintData)
+	for _, dir := range dirs {
+		if dir == "" {
+			continue
+		}
+		kindFiles, err := listKindFiles(dir)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", dir, err)
+		}
+		for _, namespace := range sortedKeys(kindFiles) {
+			if data[namespace] == nil {
+				data[namespace] = make(map[string][]*lintEntity)
+			}
+			for _, fileName := range sortedKeys(kindFiles[namespace]) {
+				kind := strings.TrimSuffix(fileName, ".json")
+				filePath := filepath.Join(dir, namespace, fileName)
+				entities, err := readKindFile(filePath)
+				if err != nil {
+					return nil, err
+				}
+
+				existing := data[namespace][kind]
+				index := make(map[string]int)
+				for i, le := range existing {
+					if le.entity.ID != "" {
+						index[entityKeyString(le.entity)] = i
+					}
+				}
+				for _, entity := range entities {
+					le := &lintEntity{entity: entity, value: entityValue(entity), file: filePath}
+					if i, ok := index[entityKeyString(entity)]; ok && entity.ID != "" {
+						existing[i] = le
+						continue
+					}
+					existing = append(existing, le)
+				}
+				data[namespace][kind] = existing
+			}
+		}
+	}
+	return data, nil
+}
+
+// entityValue returns an entity in the id/parent/data JSON shape used by property paths
+func entityValue(entity OutputEntity) interface{} {
+	return map[string]interface{}{
+		"id":     entity.ID,
+		"parent": entity.Parent,
+		"data":   dsvalue.Plain(map[string]interface{}(entity.Data)),
+	}
+}
+
+// lintReferences checks the configured references and returns the number of dangling references.
+// Dangling references are logged as errors and counted as failures of the referencing kind,
+// unreferenced targets of rules with orphans enabled are logged as warnings.
+func lintReferences(config Config, data lintData, summary *RunSummary) (int, error) {
+	dangling := 0
+	// Targets referenced by any rule, and the kinds whose unreferenced entities are orphans
+	referenced := make(map[*lintEntity]bool)
+	orphanKinds := make(map[[2]string]bool)
+	for _, rule := range config.References {
+		path, err := parsePropertyPath(rule.Path)
+		if err != nil {
+			return 0, fmt.Errorf("reference %s -> %s: %v", rule.Kind, rule.Target, err)
+		}
+		var targetField propertyPath
+		if rule.TargetField != "" {
+			if targetField, err = parsePropertyPath(rule.TargetField); err != nil {
+				return 0, fmt.Errorf("reference %s -> %s: %v", rule.Kind, rule.Target, err)
+			}
+		}
+		if rule.Scope != "" && rule.Scope != "children" && rule.Scope != "siblings" {
+			return 0, fmt.Errorf("reference %s -> %s: unknown scope %q (use children or siblings)", rule.Kind, rule.Target, rule.Scope)
+		}
+
+		for _, namespace := range sortedKeys(data) {
+			if rule.Namespace != "" && namespace != rule.Namespace {
+				continue
+			}
+			entities := data[namespace][rule.Kind]
+			if len(entities) == 0 {
+				continue
+			}
+			targetNamespace := rule.TargetNamespace
+			if targetNamespace == "" {
+				targetNamespace = namespace
+			}
+			targets, ok := data[targetNamespace][rule.Target]
+			if !ok {
+				logDebug(fmt.Sprintf("No %s entities in namespace %s, skipping references from %s", rule.Target, targetNamespace, rule.Kind), "namespace", namespace, "kind", rule.Kind)
+				continue
+			}
+			if rule.Orphans {
+				orphanKinds[[2]string{targetNamespace, rule.Target}] = true
+			}
+
+			for _, le := range entities {
+				key := entityKeyString(le.entity)
+				found := make(map[string]interface{})
+				collectValues(le.value, path, "", found)
+				for _, valuePath := range sortedKeys(found) {
+					reference, ok := referenceString(found[valuePath])
+					if !ok || reference == "" {
+						continue
+					}
+					if rule.TargetField == "" && !strings.HasPrefix(reference, rule.Target+",") && strings.Contains(reference, ",") {
+						// A parent of another kind is not covered by this rule
+						continue
+					}
+
+					matches := matchReference(le, reference, targets, rule, targetField)
+					for _, target := range matches {
+						referenced[target] = true
+					}
+					if len(matches) > 0 {
+						continue
+					}
+
+					dangling++
+					summary.Kind(namespace, rule.Kind).Failed++
+					problem := "dangling reference"
+					if valuePath == "parent" {
+						problem = "orphaned, parent does not exist"
+					}
+					logError(fmt.Sprintf("%s: entity %s: %s: %s %q to %s/%s", le.file, key, valuePath, problem, reference, targetNamespace, rule.Target),
+						entityFields(config.ProjectID, namespace, rule.Kind, key)...)
+				}
+			}
+		}
+
+	}
+
+	for _, namespace := range sortedKeys(data) {
+		for _, kind := range sortedKeys(data[namespace]) {
+			if !orphanKinds[[2]string{namespace, kind}] {
+				continue
+			}
+			for _, target := range data[namespace][kind] {
+				if !referenced[target] {
+					key := entityKeyString(target.entity)
+					logWarn(fmt.Sprintf("%s: entity %s: orphaned, not referenced by any entity", target.file, key),
+						entityFields(config.ProjectID, namespace, kind, key)...)
+				}
+			}
+		}
+	}
+	return dangling, nil
+}
+
+// matchReference returns the target entities a reference resolves to
+func matchReference(from *lintEntity, reference string, targets []*lintEntity, rule ReferenceConfig, targetField propertyPath) []*lintEntity {
+	var matches []*lintEntity
+	for _, target := range targets {
+		switch rule.Scope {
+		case "children":
+			if target.entity.Parent != rule.Kind+","+from.entity.ID {
+				continue
+			}
+		case "siblings":
+			if target.entity.Parent != from.entity.Parent {
+				continue
+			}
+		}
+
+		if targetField == nil {
+			if reference == rule.Target+","+target.entity.ID || reference == target.entity.ID {
+				matches = append(matches, target)
+			}
+			continue
+		}
+		values := make(map[string]interface{})
+		collectValues(target.value, targetField, "", values)
+		for _, value := range values {
+			if s, ok := referenceString(value); ok && s == reference {
+				matches = append(matches, target)
+				break
+			}
+		}
+	}
+	return matches
+}
+
+// referenceString turns a referencing value into the string it is matched by
+func referenceString(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case nil, map[string]interface{}, []interface{}:
+		return "", false
+	default:
+		if number, ok := toFloat(v); ok {
+			return strconv.FormatFloat(number, 'f', -1, 64), true
+		}
+		return fmt.Sprint(v), true
+	}
+}
+
+// collectValues gathers the values matching path, keyed by their concrete dotted path
+func collectValues(value interface{}, path propertyPath, prefix string, out map[string]interface{}) {
+	if len(path) == 0 {
+		out[prefix] = value
+		return
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			if matchSegment(path[0], k) {
+				collectValues(val, path[1:], joinPath(prefix, k), out)
+			}
+		}
+	case []interface{}:
+		for i, val := range v {
+			if path[0] == "*" || path[0] == strconv.Itoa(i) {
+				collectValues(val, path[1:], fmt.Sprintf("%s[%d]", prefix, i), out)
+			}
+		}
+	}
+}
+
+// lintDirs lints the local changes in dir on top of the downloaded data in baseDir (optional)
+func lintDirs(config Config, baseDir, dir string, summary *RunSummary) (int, error) {
+	if len(config.References) == 0 {
+		return 0, nil
+	}
+	data, err := loadLintData(baseDir, dir)
+	if err != nil {
+		return 0, err
+	}
+	for namespace, kinds := range data {
+		for kind := range kinds {
+			summary.Kind(namespace, kind)
+		}
+	}
+	return lintReferences(config, data, summary)
+}
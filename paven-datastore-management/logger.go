@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// levelSuccess sits between info and warn so successful outcomes survive an info filter
+const levelSuccess = slog.Level(2)
+
+// logger is the process wide structured logger, replaced by initLogger once the flags are parsed
+var logger = slog.New(newConsoleHandler(os.Stdout, slog.LevelInfo))
+
+// Settings the logger was initialised with, kept so its output can be redirected
+var (
+	logMinLevel = slog.LevelInfo
+	logAsJSON   = false
+)
+
+// initLogger configures the level, output format and colours of the logger
+func initLogger(level, format string) error {
+	var minLevel slog.Level
+	switch strings.ToLower(level) {
+	case "debug":
+		minLevel = slog.LevelDebug
+	case "info":
+		minLevel = slog.LevelInfo
+	case "warn":
+		minLevel = slog.LevelWarn
+	case "error":
+		minLevel = slog.LevelError
+	default:
+		return fmt.Errorf("invalid log level %q (use debug, info, warn or error)", level)
+	}
+
+	if !colorEnabled() {
+		disableColors()
+	}
+
+	switch strings.ToLower(format) {
+	case "text":
+		logAsJSON = false
+	case "json":
+		// Colour codes would end up inside the JSON strings of the report output as well
+		disableColors()
+		logAsJSON = true
+	default:
+		return fmt.Errorf("invalid log format %q (use text or json)", format)
+	}
+	logMinLevel = minLevel
+	setLogOutput(os.Stdout)
+	return nil
+}
+
+// setLogOutput sends log records to out, keeping the configured level and format
+func setLogOutput(out io.Writer) {
+	if logAsJSON {
+		logger = slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{
+			Level:       logMinLevel,
+			ReplaceAttr: replaceLevelName,
+		}))
+		return
+	}
+	logger = slog.New(newConsoleHandler(out, logMinLevel))
+}
+
+// colorEnabled reports whether stdout is a terminal and NO_COLOR is not set
+func colorEnabled() bool {
+	if _, ok := os.LookupEnv("NO_COLOR"); ok {
+		return false
+	}
+	info, err := os.Stdout.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// disableColors blanks the ANSI codes so every printer falls back to plain text
+func disableColors() {
+	colorReset, colorRed, colorGreen, colorYellow, colorBlue, colorCyan = "", "", "", "", "", ""
+}
+
+// levelName returns the label used for a level in both output formats
+func levelName(level slog.Level) string {
+	switch {
+	case level == levelSuccess:
+		return "SUCCESS"
+	case level >= slog.LevelError:
+		return "ERROR"
+	case level >= slog.LevelWarn:
+		return "WARN"
+	case level >= slog.LevelInfo:
+		return "INFO"
+	default:
+		return "DEBUG"
+	}
+}
+
+func replaceLevelName(groups []string, a slog.Attr) slog.Attr {
+	if a.Key == slog.LevelKey && len(groups) == 0 {
+		if level, ok := a.Value.Any().(slog.Level); ok {
+			a.Value = slog.StringValue(levelName(level))
+		}
+	}
+	return a
+}
+
+// entityFields returns the attributes identifying an entity in log records
+func entityFields(project, namespace, kind, key string) []any {
+	return []any{"project", project, "namespace", namespace, "kind", kind, "key", key}
+}
+
+// Log functions with color coding, extra arguments are key/value pairs attached to the record
+func logDebug(message string, args ...any) {
+	logger.Debug(message, args...)
+}
+
+func logInfo(message string, args ...any) {
+	logger.Info(message, args...)
+}
+
+func logWarn(message string, args ...any) {
+	logger.Warn(message, args...)
+}
+
+func logError(message string, args ...any) {
+	logger.Error(message, args...)
+}
+
+func logSuccess(message string, args ...any) {
+	logger.Log(context.Background(), levelSuccess, message, args...)
+}
+
+// consoleHandler renders records as the coloured "LEVEL: message key=value" lines of the console
+type consoleHandler struct {
+	mu    *sync.Mutex
+	out   io.Writer
+	level slog.Level
+	attrs []slog.Attr
+	group string
+}
+
+func newConsoleHandler(out io.Writer, level slog.Level) *consoleHandler {
+	return &consoleHandler{mu: &sync.Mutex{}, out: out, level: level}
+}
+
+func (h *consoleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *consoleHandler) Handle(_ context.Context, r slog.Record) error {
+	color := colorBlue
+	switch {
+	case r.Level == levelSuccess:
+		color = colorGreen
+	case r.Level >= slog.LevelError:
+		color = colorRed
+	case r.Level >= slog.LevelInfo:
+		color = colorYellow
+	}
+
+	var sb strings.Builder
+	sb.WriteString(color + levelName(r.Level) + ": " + r.Message)
+	for _, a := range h.attrs {
+		writeAttr(&sb, "", a)
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		writeAttr(&sb, h.group, a)
+		return true
+	})
+	sb.WriteString(colorReset + "\n")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.out, sb.String())
+	return err
+}
+
+func (h *consoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	clone := *h
+	clone.attrs = append([]slog.Attr{}, h.attrs...)
+	for _, a := range attrs {
+		if h.group != "" {
+			a.Key = h.group + "." + a.Key
+		}
+		clone.attrs = append(clone.attrs, a)
+	}
+	return &clone
+}
+
+func (h *consoleHandler) WithGroup(name string) slog.Handler {
+	clone := *h
+	if clone.group != "" {
+		name = clone.group + "." + name
+	}
+	clone.group = name
+	return &clone
+}
+
+func writeAttr(sb *strings.Builder, group string, a slog.Attr) {
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	a.Value = a.Value.Resolve()
+	key := a.Key
+	if group != "" {
+		key = group + "." + key
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		for _, ga := range a.Value.Group() {
+			writeAttr(sb, key, ga)
+		}
+		return
+	}
+	value := a.Value.String()
+	if value == "" || strings.ContainsAny(value, " =\"") {
+		value = fmt.Sprintf("%q", value)
+	}
+	sb.WriteString(" " + key + "=" + value)
+}
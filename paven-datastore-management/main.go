@@ -7,22 +7,22 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"strconv"
+	"sort"
 	"strings"
 
 	"cloud.google.com/go/datastore"
-	"github.com/go-test/deep"
 	"github.com/manifoldco/promptui"
 	"google.golang.org/api/iterator"
 	"gopkg.in/yaml.v2"
+
+	"paven-go/dsvalue"
 )
 
-// ANSI color codes for log messages and output
-const (
+// ANSI color codes for log messages and output, blanked by initLogger when colours are disabled
+var (
 	colorReset  = "\033[0m"
 	colorRed    = "\033[1;31m"
 	colorGreen  = "\033[1;32m"
@@ -35,12 +35,41 @@ const (
 type Config struct {
 	ProjectID string       `yaml:"projectID"`
 	Kinds     []KindConfig `yaml:"kinds"`
+	Audit     AuditConfig  `yaml:"audit"`
+
+	Environments map[string]EnvironmentConfig `yaml:"environments"`
+	SnapshotsDir string                       `yaml:"snapshotsDir"`
+	SchemasDir   string                       `yaml:"schemasDir"`
+
+	References    []ReferenceConfig   `yaml:"references"`
+	VariableUsage VariableUsageConfig `yaml:"variableUsage"`
+	I18n          I18nConfig          `yaml:"i18n"`
+	Colors        ColorsConfig        `yaml:"colors"`
+
+	// Generators is the manifest run by generate all, in order
+	Generators []GeneratorConfig `yaml:"generators"`
+	// Documents map files of the changes directory to single properties of entities
+	Documents []DocumentConfig `yaml:"documents"`
 }
 
 // KindConfig holds configuration for each kind and its namespace
 type KindConfig struct {
 	Name      string `yaml:"name"`
 	Namespace string `yaml:"namespace"`
+
+	// Ignore lists property paths (e.g. data.updatedAt, data.elements[*].id) left out of every diff
+	Ignore []string `yaml:"ignore"`
+	// PreserveIgnored keeps the remote value of ignored properties when applying
+	PreserveIgnored bool `yaml:"preserveIgnored"`
+	// Arrays lists arrays whose item order does not matter
+	Arrays []ArrayConfig `yaml:"arrays"`
+}
+
+// ArrayConfig declares an order-insensitive array. Items are matched by their Key property
+// (e.g. steps keyed by order), or by their whole value when Key is empty.
+type ArrayConfig struct {
+	Path string `yaml:"path"`
+	Key  string `yaml:"key"`
 }
 
 // OutputEntity represents the simplified JSON output for each entity
@@ -68,110 +97,154 @@ func displayHeader() {
 	fmt.Println("Use the options below to select your desired operation:\n" + colorReset)
 }
 
-// Log functions with color coding
-func logError(message string) {
-	fmt.Println(colorRed + "ERROR: " + message + colorReset)
-}
-
-func logInfo(message string) {
-	fmt.Println(colorYellow + "INFO: " + message + colorReset)
-}
-
-func logSuccess(message string) {
-	fmt.Println(colorGreen + "SUCCESS: " + message + colorReset)
+func main() {
+	os.Exit(run())
 }
 
-func main() {
+// run executes the selected action and returns the process exit code
+func run() int {
 	// Parse flags for YAML configuration file and output directory
 	configPath := flag.String("config", "config.yaml", "Path to YAML configuration file")
 	outputDir := flag.String("outputDir", "./output", "Directory to save JSON output files")
+	compareDirFlag := flag.String("compareDir", "", "Directory to compare against (skips the prompt, default is ./local_changes)")
+	applyDirFlag := flag.String("applyDir", "", "Directory containing changes to apply (skips the prompt, default is ./local_changes/)")
+	dryRunFlag := flag.Bool("dryRun", true, "Run apply in dry-run mode when no prompt is shown")
+	reviewFlag := flag.Bool("review", false, "Review every change interactively before applying")
+	mergeFlag := flag.Bool("merge", false, "Apply the kind files as JSON merge patches: properties left out are kept and null removes a property")
+	logLevel := flag.String("log-level", "info", "Minimum log level: debug, info, warn or error")
+	logFormat := flag.String("log-format", "text", "Log output format: text or json")
+	addr := flag.String("addr", "127.0.0.1:8080", "Address the serve command listens on")
+	envFlag := flag.String("env", "prod", "Environment of the authoring files read by generate, e.g. prod or stage")
+	sourceDirFlag := flag.String("sourceDir", "../utils-clean", "Directory holding the authoring files read by generate")
+	namespaceFlag := flag.String("namespace", "nsGlobalPavenDev", "Namespace of the entities written by generate")
+	entityIDFlag := flag.String("entityID", "", "ID of the entity written by generate tenant")
 	flag.Parse()
 
-	// Display header and clear console
-	displayHeader()
-
-	// Interactive menu
-	prompt := promptui.Select{
-		Label: "Select an action",
-		Items: []string{"Only Download", "Download and Compare", "Apply Changes to Database"},
-		Templates: &promptui.SelectTemplates{
-			Selected: "\U0001F4CC " + colorCyan + "{{ . }}" + colorReset,
-			Active:   colorGreen + "\U0001F4CC {{ . }}" + colorReset,
-			Inactive: colorYellow + "  {{ . }}" + colorReset,
-		},
+	if err := initLogger(*logLevel, *logFormat); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitFatal
 	}
 
-	_, choice, err := prompt.Run()
-	if err != nil {
-		log.Fatalf("Prompt failed %v\n", err)
+	// An action given on the command line runs without any prompt, which is what CI uses
+	action := flag.Arg(0)
+	interactive := action == ""
+
+	if interactive {
+		// Display header and clear console
+		displayHeader()
+
+		// Interactive menu
+		prompt := promptui.Select{
+			Label: "Select an action",
+			Items: []string{"Only Download", "Download and Compare", "Apply Changes to Database", "Browse Namespaces and Entities"},
+			Templates: &promptui.SelectTemplates{
+				Selected: "\U0001F4CC " + colorCyan + "{{ . }}" + colorReset,
+				Active:   colorGreen + "\U0001F4CC {{ . }}" + colorReset,
+				Inactive: colorYellow + "  {{ . }}" + colorReset,
+			},
+		}
+
+		_, choice, err := prompt.Run()
+		if err != nil {
+			logError(fmt.Sprintf("Prompt failed %v", err))
+			return exitFatal
+		}
+
+		switch choice {
+		case "Only Download":
+			action = "download"
+		case "Download and Compare":
+			action = "compare"
+		case "Apply Changes to Database":
+			action = "apply"
+		case "Browse Namespaces and Entities":
+			action = "tui"
+		}
 	}
 
 	// Load configuration
 	config, err := loadConfig(*configPath)
 	if err != nil {
 		logError(fmt.Sprintf("Failed to load configuration: %v", err))
-		return
+		return exitFatal
 	}
 
 	// Create output directory if it doesn't exist
 	if err := os.MkdirAll(*outputDir, os.ModePerm); err != nil {
 		logError(fmt.Sprintf("Failed to create output directory: %v", err))
-		return
+		return exitFatal
 	}
 
-	switch choice {
-	case "Only Download":
+	summary := newRunSummary()
+
+	switch action {
+	case "download":
 		logInfo("Starting download...")
 		if err := retrieveAndSaveJSON(config, *outputDir); err != nil {
 			logError(fmt.Sprintf("Error retrieving datastore data: %v", err))
-			return
+			return exitFatal
 		}
 		logSuccess("Data downloaded successfully.")
+		return exitSuccess
 
-	case "Download and Compare":
+	case "compare":
 		logInfo("Starting download...")
 		if err := retrieveAndSaveJSON(config, *outputDir); err != nil {
 			logError(fmt.Sprintf("Error retrieving datastore data: %v", err))
-			return
+			return exitFatal
 		}
 		logSuccess("Data downloaded successfully.")
 
 		// Prompt for comparison directory
-		reader := bufio.NewReader(os.Stdin)
-		fmt.Print(colorCyan + "Enter the directory path to compare against (default is ./local_changes): " + colorReset)
-		compareDir, _ := reader.ReadString('\n')
-		compareDir = strings.TrimSpace(compareDir)
+		compareDir := *compareDirFlag
+		if compareDir == "" && interactive {
+			reader := bufio.NewReader(os.Stdin)
+			fmt.Print(colorCyan + "Enter the directory path to compare against (default is ./local_changes): " + colorReset)
+			compareDir, _ = reader.ReadString('\n')
+			compareDir = strings.TrimSpace(compareDir)
+		}
 		if compareDir == "" {
 			compareDir = "./local_changes"
 		}
 
-		if err := compareOutput(*outputDir, compareDir); err != nil {
+		if err := compareOutput(config, *outputDir, compareDir, summary); err != nil {
 			logError(fmt.Sprintf("Error comparing output files: %v", err))
-		}
+			return exitFatal
+		}
+		summary.Print()
+		return summary.ExitCode(true)
+
+	case "apply":
+		dryRun, review := *dryRunFlag, *reviewFlag
+		if interactive {
+			// Prompt for dry-run mode (Yes by default)
+			dryRunPrompt := promptui.Select{
+				Label: "Enable dry-run mode? (no changes will be applied to database)",
+				Items: []string{"Yes", "No", "No, review each change first"},
+				Templates: &promptui.SelectTemplates{
+					Selected: colorCyan + "Dry-run: {{ . }}" + colorReset,
+					Active:   colorGreen + "\U0001F4CC {{ . }}" + colorReset,
+					Inactive: colorYellow + "  {{ . }}" + colorReset,
+				},
+			}
+			_, dryRunChoice, err := dryRunPrompt.Run()
+			if err != nil {
+				logError(fmt.Sprintf("Prompt failed %v", err))
+				return exitFatal
+			}
 
-	case "Apply Changes to Database":
-		// Prompt for dry-run mode (Yes by default)
-		dryRunPrompt := promptui.Select{
-			Label: "Enable dry-run mode? (no changes will be applied to database)",
-			Items: []string{"Yes", "No"},
-			Templates: &promptui.SelectTemplates{
-				Selected: colorCyan + "Dry-run: {{ . }}" + colorReset,
-				Active:   colorGreen + "\U0001F4CC {{ . }}" + colorReset,
-				Inactive: colorYellow + "  {{ . }}" + colorReset,
-			},
-		}
-		_, dryRunChoice, err := dryRunPrompt.Run()
-		if err != nil {
-			log.Fatalf("Prompt failed %v\n", err)
+			dryRun = dryRunChoice == "Yes"
+			review = dryRunChoice == "No, review each change first"
 		}
 
-		dryRun := dryRunChoice == "Yes"
-
 		// Prompt for directory containing changes to apply
-		reader := bufio.NewReader(os.Stdin)
-		fmt.Print(colorCyan + "Enter the directory path containing changes to apply (default is ./local_changes/): " + colorReset)
-		applyDir, _ := reader.ReadString('\n')
-		applyDir = strings.TrimSpace(applyDir)
+		applyDir := *applyDirFlag
+		if applyDir == "" && interactive {
+			reader := bufio.NewReader(os.Stdin)
+			fmt.Print(colorCyan + "Enter the directory path containing changes to apply (default is ./local_changes/): " + colorReset)
+			applyDir, _ = reader.ReadString('\n')
+			applyDir = strings.TrimSpace(applyDir)
+		}
 		if applyDir == "" {
 			applyDir = "./local_changes/"
 		}
@@ -180,295 +253,445 @@ func main() {
 			logInfo("Dry-run mode enabled. Changes will not be applied to the database.")
 		}
 
-		if err := applyChangesToDatabase(config.ProjectID, applyDir, dryRun); err != nil {
+		if err := applyChangesToDatabase(config, applyDir, applyOptions{DryRun: dryRun, Review: review, Merge: *mergeFlag, BaseDir: *outputDir}, summary); err != nil {
 			logError(fmt.Sprintf("Error applying changes to database: %v", err))
-		} else {
-			if dryRun {
-				logSuccess("Dry-run completed. JSON output generated for review.")
-			} else {
-				logSuccess("Changes applied to the database successfully.")
-			}
+			summary.Print()
+			return exitFatal
 		}
+		summary.Print()
 
-	default:
-		logError("Invalid choice. Please run the program again.")
-	}
-}
+		if summary.HasFailures() {
+			logError("Some changes could not be applied, see the errors above.")
+		} else if dryRun {
+			logSuccess("Dry-run completed. JSON output generated for review.")
+		} else {
+			logSuccess("Changes applied to the database successfully.")
+		}
+		return summary.ExitCode(false)
 
-// loadConfig loads the yaml config to be used to obtain the datastore data
-func loadConfig(path string) (Config, error) {
-	var config Config
-	data, err := ioutil.ReadFile(path)
-	if err != nil {
-		return config, fmt.Errorf("failed to read config file: %v", err)
-	}
+	case "diff":
+		left, right := flag.Arg(1), flag.Arg(2)
+		if left == "" || right == "" {
+			logError("Usage: diff <left> <right> where each side is <dir>, snapshot:<name>, env:<name> or git:<rev>[:<dir>]")
+			return exitFatal
+		}
+		if err := diffSources(config, left, right, summary); err != nil {
+			logError(fmt.Sprintf("Error comparing %s with %s: %v", left, right, err))
+			return exitFatal
+		}
+		summary.Print()
+		return summary.ExitCode(true)
 
-	if err := yaml.Unmarshal(data, &config); err != nil {
-		return config, fmt.Errorf("failed to parse config file: %v", err)
-	}
+	case "snapshot":
+		logInfo("Starting download...")
+		dir, err := saveSnapshot(config, flag.Arg(1))
+		if err != nil {
+			logError(fmt.Sprintf("Error saving snapshot: %v", err))
+			return exitFatal
+		}
+		logSuccess(fmt.Sprintf("Snapshot saved to %s", dir))
+		return exitSuccess
 
-	return config, nil
-}
+	case "tui":
+		applyDir := *applyDirFlag
+		if applyDir == "" {
+			applyDir = "./local_changes/"
+		}
+		if err := runBrowser(config, *outputDir, applyDir); err != nil {
+			logError(fmt.Sprintf("Error running the terminal UI: %v", err))
+			return exitFatal
+		}
+		return exitSuccess
 
-func applyChangesToDatabase(projectID, applyDir string, dryRun bool) error {
-	ctx := context.Background()
-	client, err := datastore.NewClient(ctx, projectID)
-	if err != nil {
-		return fmt.Errorf("failed to create datastore client: %v", err)
-	}
-	defer client.Close()
+	case "validate":
+		dir := flag.Arg(1)
+		if dir == "" {
+			dir = *applyDirFlag
+		}
+		if dir == "" {
+			dir = "./local_changes/"
+		}
+		violations, err := validateDir(config, dir, summary)
+		if err != nil {
+			logError(fmt.Sprintf("Error validating %s: %v", dir, err))
+			return exitFatal
+		}
+		summary.Print()
+		if len(violations) > 0 {
+			logError(fmt.Sprintf("%d schema violations found in %s", len(violations), dir))
+		} else {
+			logSuccess(fmt.Sprintf("Every entity in %s matches its schema.", dir))
+		}
+		return summary.ExitCode(false)
 
-	dryRunDir := filepath.Join("local_changes", "dry_run")
+	case "lint":
+		dir := flag.Arg(1)
+		if dir == "" {
+			dir = *applyDirFlag
+		}
+		if dir == "" {
+			dir = "./local_changes/"
+		}
+		if len(config.References) == 0 {
+			logWarn("No references configured, nothing to lint. See references in config-all.yaml.")
+			return exitSuccess
+		}
+		baseDir := *outputDir
+		if filepath.Clean(baseDir) == filepath.Clean(dir) {
+			baseDir = ""
+		}
+		dangling, err := lintDirs(config, baseDir, dir, summary)
+		if err != nil {
+			logError(fmt.Sprintf("Error linting %s: %v", dir, err))
+			return exitFatal
+		}
+		summary.Print()
+		if dangling > 0 {
+			logError(fmt.Sprintf("%d dangling references found in %s", dangling, dir))
+		} else {
+			logSuccess(fmt.Sprintf("Every reference in %s resolves.", dir))
+		}
+		return summary.ExitCode(false)
 
-	if dryRun {
-		if _, err := os.Stat(dryRunDir); err == nil {
-			if err := os.RemoveAll(dryRunDir); err != nil {
-				return fmt.Errorf("failed to clear dry_run directory: %v", err)
+	case "analyze":
+		analysis, dir := flag.Arg(1), flag.Arg(2)
+		if analysis != "variables" && analysis != "i18n" && analysis != "colors" {
+			logError("Usage: analyze variables|i18n|colors [dir], analysing the changes directory laid over -outputDir")
+			return exitFatal
+		}
+		if dir == "" {
+			dir = *applyDirFlag
+		}
+		if dir == "" {
+			dir = "./local_changes/"
+		}
+		baseDir := *outputDir
+		if filepath.Clean(baseDir) == filepath.Clean(dir) {
+			baseDir = ""
+		}
+		data, err := loadLintData(baseDir, dir)
+		if err != nil {
+			logError(fmt.Sprintf("Error reading %s: %v", dir, err))
+			return exitFatal
+		}
+		if analysis == "i18n" {
+			problems, err := analyzeI18n(config, data, summary)
+			if err != nil {
+				logError(fmt.Sprintf("Error analysing translation keys: %v", err))
+				return exitFatal
+			}
+			summary.Print()
+			if problems > 0 {
+				logError(fmt.Sprintf("%d malformed or untranslated keys found in %s", problems, dir))
+			} else {
+				logSuccess(fmt.Sprintf("Every key referenced in %s is well formed and translated.", dir))
+			}
+			return summary.ExitCode(false)
+		}
+		if analysis == "colors" {
+			problems, err := analyzeColors(config, data, summary)
+			if err != nil {
+				logError(fmt.Sprintf("Error analysing colours: %v", err))
+				return exitFatal
+			}
+			summary.Print()
+			if problems > 0 {
+				logError(fmt.Sprintf("%d malformed colours or low contrast pairs found in %s", problems, dir))
+			} else {
+				logSuccess(fmt.Sprintf("Every colour in %s is well formed and every pair has enough contrast.", dir))
 			}
+			return summary.ExitCode(false)
 		}
-		if err := os.MkdirAll(dryRunDir, os.ModePerm); err != nil {
-			return fmt.Errorf("failed to create dry_run directory: %v", err)
+		problems := analyzeVariables(config, data, summary)
+		summary.Print()
+		if problems > 0 {
+			logError(fmt.Sprintf("%d variable problems found in %s", problems, dir))
+		} else {
+			logSuccess(fmt.Sprintf("Every variable used in %s is defined and every input range is valid.", dir))
 		}
-	}
+		return summary.ExitCode(false)
 
-	namespaces, err := ioutil.ReadDir(applyDir)
-	if err != nil {
-		return fmt.Errorf("failed to read apply directory: %v", err)
-	}
+	case "schema":
+		target := flag.Arg(2)
+		if flag.Arg(1) != "infer" || target == "" {
+			logError("Usage: schema infer <kind|namespace/kind> [file], reading -outputDir and writing to the schemas directory by default (- for stdout)")
+			return exitFatal
+		}
+		schema, err := inferSchema(*outputDir, target)
+		if err != nil {
+			logError(fmt.Sprintf("Error inferring schema: %v", err))
+			return exitFatal
+		}
+		file := flag.Arg(3)
+		if file == "" {
+			file = filepath.Join(newSchemaSet(config).dir, filepath.FromSlash(target)+".json")
+		}
+		if err := writeInferredSchema(schema, file); err != nil {
+			logError(fmt.Sprintf("Error writing schema: %v", err))
+			return exitFatal
+		}
+		if file != "-" {
+			logSuccess(fmt.Sprintf("Schema for %s written to %s", target, file))
+		}
+		return exitSuccess
 
-	for _, ns := range namespaces {
-		if ns.Name() == "dry_run" || !ns.IsDir() {
-			continue
+	case "generate":
+		mode, name, dir := "", flag.Arg(1), flag.Arg(2)
+		if name == "reverse" || name == "check" {
+			mode, name, dir = name, flag.Arg(2), flag.Arg(3)
+		}
+		if _, ok := generators[name]; !ok && name != "all" {
+			names := strings.Join(generatorNames(), "|")
+			logError(fmt.Sprintf("Usage: generate all|%s [dir], writing the generated entities to the changes directory, generate reverse all|%s [dir] to rebuild the authoring files from the download, or generate check all|%s to find drift between them. journeys-config and themes set one property of the journeys/config entity, which must be in the changes directory or -outputDir", names, names, names))
+			return exitFatal
+		}
+		entries := config.Generators
+		if name != "all" {
+			entries = generatorEntries(config, name)
+		} else if len(entries) == 0 {
+			logError("No generators configured, nothing to generate. See generators in config-all.yaml.")
+			return exitFatal
 		}
+		base := generateOptions{SourceDir: *sourceDirFlag, EntityID: *entityIDFlag, Env: *envFlag, Namespace: *namespaceFlag, OutputDir: *outputDir, Dir: dir}
 
-		namespaceDir := filepath.Join(applyDir, ns.Name())
-		dryRunNamespaceDir := filepath.Join(dryRunDir, ns.Name())
-		if dryRun {
-			if err := os.MkdirAll(dryRunNamespaceDir, os.ModePerm); err != nil {
-				return fmt.Errorf("failed to create namespace directory %s: %v", dryRunNamespaceDir, err)
+		switch mode {
+		case "reverse":
+			if dir == "" {
+				dir = "./reversed/"
+			}
+			for _, entry := range entries {
+				if err := writeReversed(entry, base, dir); err != nil {
+					logError(fmt.Sprintf("Error reversing %s: %v", entry.Name, err))
+					return exitFatal
+				}
+			}
+			logSuccess(fmt.Sprintf("Authoring files rebuilt from %s written to %s, compare them with %s.", *outputDir, dir, *sourceDirFlag))
+			return exitSuccess
+		case "check":
+			for _, entry := range entries {
+				if err := checkGeneratorDrift(entry, base, summary); err != nil {
+					summary.Print()
+					logError(fmt.Sprintf("Error checking %s: %v", entry.Name, err))
+					return exitFatal
+				}
 			}
+			summary.Print()
+			return summary.ExitCode(true)
 		}
 
-		files, err := ioutil.ReadDir(namespaceDir)
-		if err != nil {
-			logError(fmt.Sprintf("Failed to read namespace directory %s: %v", namespaceDir, err))
-			continue
+		if dir == "" {
+			base.Dir = *applyDirFlag
 		}
+		if base.Dir == "" {
+			base.Dir = "./local_changes/"
+		}
+		if name == "all" {
+			failed := generateAll(config, base, summary)
+			summary.Print()
+			if failed > 0 {
+				logError(fmt.Sprintf("%d of %d generators failed, the others were written to %s", failed, len(config.Generators), base.Dir))
+				return exitPartialFailure
+			}
+			logSuccess(fmt.Sprintf("Generated entities written to %s, run compare or apply to push them.", base.Dir))
+			return exitSuccess
+		}
+		for _, entry := range entries {
+			if _, err := runGenerator(entry, base, summary); err != nil {
+				summary.Print()
+				logError(fmt.Sprintf("Error generating %s: %v", name, err))
+				return exitFatal
+			}
+		}
+		summary.Print()
+		logSuccess(fmt.Sprintf("Generated %s written to %s, run compare or apply to push them.", name, base.Dir))
+		return exitSuccess
 
-		for _, file := range files {
-			kind := strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))
-			filePath := filepath.Join(namespaceDir, file.Name())
-
-			data, err := ioutil.ReadFile(filePath)
+	case "convert":
+		to, file := flag.Arg(1), flag.Arg(2)
+		if (to != "plain" && to != "typed" && to != "check" && to != "kind") || file == "" || (to == "kind" && flag.NArg() < 4) {
+			logError("Usage: convert plain|typed <file> [out], converting between Datastore REST typed JSON and plain JSON (stdout by default), convert check <file|dir>... to check typed JSON files, or convert kind <kind>[/<id>[.<property>]] <file>... to write typed JSON files as entities to the changes directory")
+			return exitFatal
+		}
+		if to == "kind" {
+			dir := *applyDirFlag
+			if dir == "" {
+				dir = "./local_changes/"
+			}
+			opts := generateOptions{Namespace: *namespaceFlag, OutputDir: *outputDir, Dir: dir}
+			if err := convertToKindFile(file, flag.Args()[3:], opts, summary); err != nil {
+				summary.Print()
+				logError(fmt.Sprintf("Error converting to %s: %v", file, err))
+				return exitFatal
+			}
+			summary.Print()
+			logSuccess(fmt.Sprintf("Converted entities written to %s, run compare or apply to push them.", dir))
+			return exitSuccess
+		}
+		if to == "check" {
+			problems, err := checkTypedFiles(flag.Args()[2:])
 			if err != nil {
-				logError(fmt.Sprintf("Error reading file %s: %v", filePath, err))
-				continue
+				logError(fmt.Sprintf("Error checking typed JSON: %v", err))
+				return exitFatal
 			}
-
-			var entities []OutputEntity
-			if err := json.Unmarshal(data, &entities); err != nil {
-				logError(fmt.Sprintf("Error unmarshalling JSON in file %s: %v", filePath, err))
-				continue
+			if problems > 0 {
+				logError(fmt.Sprintf("%d invalid values found, regenerate the files listed above", problems))
+				return exitPartialFailure
 			}
+			logSuccess("Every typed JSON file is valid.")
+			return exitSuccess
+		}
+		if err := convertFile(to, file, flag.Arg(3)); err != nil {
+			logError(fmt.Sprintf("Error converting %s: %v", file, err))
+			return exitFatal
+		}
+		if out := flag.Arg(3); out != "" && out != "-" {
+			logSuccess(fmt.Sprintf("%s converted to %s JSON in %s", file, to, out))
+		}
+		return exitSuccess
 
-			var changesForKind []datastore.Entity
-
-			// Loop through each entity in the JSON data to prepare for database actions
-			// Loop through each entity in the JSON data to prepare for database actions
-			for _, entity := range entities {
-				var key, parentKey *datastore.Key
-
-				// Handle parent key creation
-				if entity.Parent != "" {
-					parentArr := strings.Split(entity.Parent, ",")
-					if parentID, err := strconv.ParseInt(parentArr[1], 10, 64); err == nil {
-						parentKey = datastore.IDKey(parentArr[0], parentID, nil)
-					} else {
-						parentKey = datastore.NameKey(parentArr[0], parentArr[1], nil)
-					}
-					parentKey.Namespace = ns.Name()
-				}
-
-				// Determine the appropriate key based on entity.ID presence
-				if entity.ID == "" {
-					// If entity.ID is empty, use IncompleteKey to create a new entity with a generated ID
-					key = datastore.IncompleteKey(kind, parentKey)
-				} else {
-					// If entity.ID is present, use it to define a specific key
-					if idInt, err := strconv.ParseInt(entity.ID, 10, 64); err == nil {
-						key = datastore.IDKey(kind, idInt, parentKey)
-					} else {
-						key = datastore.NameKey(kind, entity.ID, parentKey)
-					}
-				}
-				key.Namespace = ns.Name()
-
-				// Skip datastore fetch if entity.ID is empty (new entity)
-				var existingDataMap map[string]interface{}
-				var diff []string
-				// Prepare the new data map for comparison or new entity creation
-				newDataMap := make(map[string]interface{})
-				for k, v := range entity.Data {
-					newDataMap[k] = simplifyValue(v)
-				}
-				if entity.ID != "" {
-					var existingData datastore.PropertyList
-					err := client.Get(ctx, key, &existingData)
-					if err != nil && err != datastore.ErrNoSuchEntity {
-						logError(fmt.Sprintf("Error fetching entity with ID %s from Datastore: %v", entity.ID, err))
-						continue
-					}
-					existingDataMap = propertyListToMap(existingData)
-				}
+	case "extract":
+		dir := flag.Arg(1)
+		if dir == "" {
+			dir = *applyDirFlag
+		}
+		if dir == "" {
+			dir = "./local_changes/"
+		}
+		if len(config.Documents) == 0 {
+			logError("No documents configured, nothing to extract. See documents in config-all.yaml.")
+			return exitFatal
+		}
+		if err := extractDocuments(config, *outputDir, dir); err != nil {
+			logError(fmt.Sprintf("Error extracting documents: %v", err))
+			return exitFatal
+		}
+		logSuccess(fmt.Sprintf("Documents written to %s, edit them and run compare or apply to push them.", dir))
+		return exitSuccess
 
-				diff = deep.Equal(existingDataMap, newDataMap)
+	case "serve":
+		applyDir := *applyDirFlag
+		if applyDir == "" {
+			applyDir = "./local_changes/"
+		}
+		if err := runServer(config, *addr, *outputDir, applyDir); err != nil {
+			logError(fmt.Sprintf("Error running the server: %v", err))
+			return exitFatal
+		}
+		return exitSuccess
 
-				// In dry-run mode, log all changes (including new entities)
-				if dryRun && (entity.ID == "" || len(diff) > 0) {
-					logInfo(fmt.Sprintf("Dry-run: preparing entity for creation/update with ID %s. Differences: %v", entity.ID, diff))
-					properties, _ := mapToPropertyList(newDataMap)
-					changesForKind = append(changesForKind, datastore.Entity{
-						Key:        key,
-						Properties: properties,
-					})
-				}
+	case "history":
+		target := flag.Arg(1)
+		if target == "" {
+			logError("Usage: history <kind,id> (or <kind> for every entity of the kind)")
+			return exitFatal
+		}
+		if err := showHistory(config, target); err != nil {
+			logError(fmt.Sprintf("Error reading audit history: %v", err))
+			return exitFatal
+		}
+		return exitSuccess
 
-				// Apply changes in non-dry-run mode only if there are differences
-				if !dryRun && len(diff) > 0 {
-					logInfo(fmt.Sprintf("Applying updates for entity with ID %s", entity.ID))
-					properties, err := mapToPropertyList(newDataMap)
-					if err != nil {
-						logError(fmt.Sprintf("Error converting data map for entity with ID %s: %v", entity.ID, err))
-						continue
-					}
-					if _, err := client.Put(ctx, key, &properties); err != nil {
-						logError(fmt.Sprintf("Error applying entity with ID %s in file %s: %v", entity.ID, filePath, err))
-					} else {
-						logInfo(fmt.Sprintf("Updated entity with ID %s in Datastore", entity.ID))
-					}
-				}
-			}
+	default:
+		logError(fmt.Sprintf("Invalid action %q. Use download, compare, apply, diff, snapshot, history, validate, lint, analyze, schema, convert, generate, extract, tui or serve, or run without arguments for the menu.", action))
+		return exitFatal
+	}
+}
 
-			// Write out dry-run file if there are changes
-			if dryRun && len(changesForKind) > 0 {
-				dryRunFile := filepath.Join(dryRunNamespaceDir, fmt.Sprintf("%s_dry_run.json", kind))
-				jsonData, err := json.MarshalIndent(changesForKind, "", "  ")
-				if err != nil {
-					return fmt.Errorf("failed to marshal dry-run output for kind %s: %v", kind, err)
-				}
+// loadConfig loads the yaml config to be used to obtain the datastore data
+func loadConfig(path string) (Config, error) {
+	var config Config
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, fmt.Errorf("failed to read config file: %v", err)
+	}
 
-				if err := ioutil.WriteFile(dryRunFile, jsonData, 0644); err != nil {
-					return fmt.Errorf("failed to write dry-run JSON output for kind %s: %v", kind, err)
-				}
-				logInfo(fmt.Sprintf("Dry-run output saved to %s", dryRunFile))
-			}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("failed to parse config file: %v", err)
+	}
 
-			if dryRun && len(changesForKind) > 0 {
-				dryRunFile := filepath.Join(dryRunNamespaceDir, fmt.Sprintf("%s_dry_run.json", kind))
-				jsonData, err := json.MarshalIndent(changesForKind, "", "  ")
-				if err != nil {
-					return fmt.Errorf("failed to marshal dry-run output for kind %s: %v", kind, err)
-				}
+	return config, nil
+}
 
-				if err := ioutil.WriteFile(dryRunFile, jsonData, 0644); err != nil {
-					return fmt.Errorf("failed to write dry-run JSON output for kind %s: %v", kind, err)
-				}
-				logInfo(fmt.Sprintf("Dry-run output saved to %s", dryRunFile))
-			}
+// applyChangesToDatabase pushes the entities found in applyDir to Datastore (or into the dry_run
+// directory) and records per kind counters in summary. Errors for single files or entities are
+// logged, counted as failures and skipped; only errors that stop the whole run are returned.
+// The kind files must match their schemas and their references must resolve (on top of the
+// download in opts.BaseDir), otherwise nothing is applied.
+// With review enabled the operator decides on every change first. The plan, with the decision
+// and result of every change, is saved to plan.json in applyDir.
+func applyChangesToDatabase(config Config, applyDir string, opts applyOptions, summary *RunSummary) error {
+	// Merge patches hold only some properties, their result is validated once merged
+	if !opts.Merge {
+		violations, err := validateDir(config, applyDir, newRunSummary())
+		if err != nil {
+			return fmt.Errorf("failed to validate %s: %v", applyDir, err)
+		}
+		if len(violations) > 0 {
+			return fmt.Errorf("%d schema violations in %s, fix the errors above before applying", len(violations), applyDir)
 		}
 	}
+	dangling, err := lintDirs(config, opts.BaseDir, applyDir, newRunSummary())
+	if err != nil {
+		return fmt.Errorf("failed to lint %s: %v", applyDir, err)
+	}
+	if dangling > 0 {
+		return fmt.Errorf("%d dangling references in %s, fix the errors above before applying", dangling, applyDir)
+	}
 
-	return nil
-}
-
-func mapToPropertyList(data map[string]interface{}) (datastore.PropertyList, error) {
-	var properties datastore.PropertyList
+	ctx := context.Background()
+	client, err := datastore.NewClient(ctx, config.ProjectID)
+	if err != nil {
+		return fmt.Errorf("failed to create datastore client: %v", err)
+	}
+	defer client.Close()
 
-	for key, value := range data {
-		convertedValue, err := convertValueToDatastore(value)
+	plan, err := buildPlan(ctx, client, config, applyDir, opts.Merge, summary)
+	if err != nil {
+		return err
+	}
+	// Documents are only part of an entity, the entities they are set on are validated here
+	merged := plan
+	if !opts.Merge {
+		merged = plan.documentChanges()
+	}
+	if len(merged.Changes) > 0 {
+		violations, err := validatePlan(config, merged)
 		if err != nil {
-			return nil, fmt.Errorf("failed to convert property %s: %v", key, err)
+			return fmt.Errorf("failed to validate the merged entities: %v", err)
+		}
+		if len(violations) > 0 {
+			return fmt.Errorf("%d schema violations in the merged entities, fix the errors above before applying", len(violations))
 		}
-		properties = append(properties, datastore.Property{
-			Name:  key,
-			Value: convertedValue,
-		})
 	}
-	return properties, nil
-}
 
-func convertValueToDatastore(value interface{}) (interface{}, error) {
-	switch v := value.(type) {
-	case map[string]interface{}:
-		// For nested maps, convert to a datastore.Entity
-		propertyList, err := mapToPropertyList(v)
-		if err != nil {
-			return nil, err
-		}
-		return &datastore.Entity{Properties: propertyList}, nil
-	case []interface{}:
-		// For slices, recursively convert each item
-		var items []interface{}
-		for _, item := range v {
-			convertedItem, err := convertValueToDatastore(item)
-			if err != nil {
-				return nil, err
-			}
-			items = append(items, convertedItem)
+	if opts.Only != nil {
+		plan.filter(opts.Only)
+	}
+
+	if opts.Review && len(plan.Changes) > 0 {
+		if err := reviewPlan(config, plan, opts.BaseDir, applyDir); err != nil {
+			return err
 		}
-		return items, nil
-	case int64, string, bool, float64:
-		// Return primitive types as-is
-		return v, nil
-	default:
-		return nil, fmt.Errorf("unsupported property type: %T", v)
 	}
-}
+	plan.acceptAll()
 
-// Convert PropertyList to a simplified map[string]interface{} (used for comparison)
-func propertyListToMap(pl datastore.PropertyList) map[string]interface{} {
-	dataMap := make(map[string]interface{})
-	for _, prop := range pl {
-		dataMap[prop.Name] = simplifyValue(prop.Value)
+	if err := executePlan(ctx, client, config, plan, opts.DryRun, summary); err != nil {
+		return err
+	}
+	planFile := planPath(applyDir)
+	if err := savePlan(plan, planFile); err != nil {
+		return err
 	}
-	return dataMap
+	logInfo(fmt.Sprintf("Plan saved to %s", planFile), "project", config.ProjectID)
+	return nil
 }
 
-// Recursive function to simplify complex types into JSON-friendly values
-func simplifyValue(value interface{}) interface{} {
-	switch v := value.(type) {
-	case float64:
-		// Convert float64 to int64 if it represents a whole number
-		if v == float64(int64(v)) {
-			return int64(v)
-		}
-		return v
-	case map[string]interface{}:
-		// Recursively simplify map values
-		simplifiedMap := make(map[string]interface{})
-		for key, val := range v {
-			simplifiedMap[key] = simplifyValue(val)
-		}
-		return simplifiedMap
-	case []interface{}:
-		// Recursively simplify array elements
-		for i := range v {
-			v[i] = simplifyValue(v[i])
-		}
-		return v
-	case datastore.PropertyList:
-		return propertyListToMap(v)
-	case *datastore.Entity:
-		return propertyListToMap(v.Properties)
-	case []*datastore.Key:
-		var keys []string
-		for _, key := range v {
-			keys = append(keys, key.String())
-		}
-		return keys
-	default:
-		return v
+// entityKeyString identifies a local entity as "parentKind,parentID/id" for logs and reports
+func entityKeyString(entity OutputEntity) string {
+	if entity.Parent == "" {
+		return entity.ID
 	}
+	return entity.Parent + "/" + entity.ID
 }
 
 // Retrieves the entity ID from the datastore.Key as a string
@@ -521,7 +744,7 @@ func retrieveAndSaveJSON(config Config, outputDir string) error {
 			outputEntity := OutputEntity{
 				ID:     getEntityID(key),        // Extract only the specific entity ID part
 				Parent: getParentKeyString(key), // Include both kind and ID for the parent entity
-				Data:   propertyListToMap(data),
+				Data:   dsvalue.FromPropertyList(data),
 			}
 			outputEntities = append(outputEntities, outputEntity)
 		}
@@ -541,120 +764,232 @@ func retrieveAndSaveJSON(config Config, outputDir string) error {
 		if err := ioutil.WriteFile(filePath, jsonData, 0644); err != nil {
 			return fmt.Errorf("failed to write JSON file for kind %s: %v", kindConfig.Name, err)
 		}
-		logInfo(fmt.Sprintf("Data for kind '%s' (namespace '%s') saved to %s", kindConfig.Name, kindConfig.Namespace, filePath))
+		logInfo(fmt.Sprintf("Data for kind '%s' (namespace '%s') saved to %s", kindConfig.Name, kindConfig.Namespace, filePath),
+			"project", config.ProjectID, "namespace", kindConfig.Namespace, "kind", kindConfig.Name, "entities", len(outputEntities))
 	}
 
 	return nil
 }
 
 // compareOutput compares the generated JSON files in outputDir with the JSON files in compareDir
-// and displays differences on a line-by-line basis.
-func compareOutput(outputDir, compareDir string) error {
-	namespaces, err := ioutil.ReadDir(outputDir)
+// and displays differences on a line-by-line basis. Entity level counters are recorded in summary,
+// seen from the compare directory: entities only found there count as created, entities only found
+// in outputDir count as deleted. Both directories are walked, so namespaces and kinds that exist on
+// one side only are reported as added (compare side) or removed (output side). Properties ignored
+// by the kind rules are removed from both sides before comparing, and order-insensitive arrays are
+// sorted by item identity, with moved items reported separately.
+func compareOutput(config Config, outputDir, compareDir string, summary *RunSummary) error {
+	rules, err := newDiffRules(config)
+	if err != nil {
+		return fmt.Errorf("invalid comparison rules: %v", err)
+	}
+
+	outputFiles, err := listKindFiles(outputDir)
 	if err != nil {
 		return fmt.Errorf("failed to read output directory: %v", err)
 	}
+	compareFiles, err := listKindFiles(compareDir)
+	if err != nil {
+		return fmt.Errorf("failed to read comparison directory: %v", err)
+	}
+
+	for _, ns := range unionKeys(outputFiles, compareFiles) {
+		namespaceDir := filepath.Join(outputDir, ns)
+		compareNamespaceDir := filepath.Join(compareDir, ns)
+
+		if _, ok := compareFiles[ns]; !ok {
+			logWarn(fmt.Sprintf("Namespace %s removed: only present in %s", ns, outputDir), "namespace", ns)
+		} else if _, ok := outputFiles[ns]; !ok {
+			logWarn(fmt.Sprintf("Namespace %s added: only present in %s", ns, compareDir), "namespace", ns)
+		}
+
+		for _, fileName := range unionKeys(outputFiles[ns], compareFiles[ns]) {
+			outputFilePath := filepath.Join(namespaceDir, fileName)
+			compareFilePath := filepath.Join(compareNamespaceDir, fileName)
+			kind := strings.TrimSuffix(fileName, filepath.Ext(fileName))
+			kindSummary := summary.Kind(ns, kind)
+			fields := []any{"namespace", ns, "kind", kind}
+			kindRules := rules.forKind(ns, kind)
+
+			var outputData, compareData []byte
+			if outputFiles[ns][fileName] {
+				if outputData, err = ioutil.ReadFile(outputFilePath); err != nil {
+					logError(fmt.Sprintf("Error reading output file %s: %v", outputFilePath, err), fields...)
+					kindSummary.Failed++
+					continue
+				}
+			}
+			if compareFiles[ns][fileName] {
+				if compareData, err = ioutil.ReadFile(compareFilePath); err != nil {
+					logError(fmt.Sprintf("Error reading comparison file %s: %v", compareFilePath, err), fields...)
+					kindSummary.Failed++
+					continue
+				}
+			}
+
+			switch {
+			case compareData == nil:
+				logWarn(fmt.Sprintf("Kind %s removed: %s has no counterpart in %s", kind, outputFilePath, compareDir), fields...)
+				kindSummary.Status = "removed"
+			case outputData == nil:
+				logWarn(fmt.Sprintf("Kind %s added: %s has no counterpart in %s", kind, compareFilePath, outputDir), fields...)
+				kindSummary.Status = "added"
+			default:
+				logInfo(fmt.Sprintf("Comparing file: %s", fileName), fields...)
+			}
+
+			display := outputData != nil && compareData != nil
+			if err := countEntityChanges(outputData, compareData, kindRules, kindSummary, display); err != nil {
+				logError(fmt.Sprintf("Error comparing entities in file %s: %v", fileName, err), fields...)
+				kindSummary.Failed++
+			}
+		}
+	}
+	return compareDocuments(config, rules, outputDir, compareDir, summary)
+}
 
+// listKindFiles returns the JSON kind files of every namespace directory in dir, keyed by namespace.
+// The dry_run directory written by apply is not a namespace and is skipped.
+func listKindFiles(dir string) (map[string]map[string]bool, error) {
+	namespaces, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	kindFiles := make(map[string]map[string]bool)
 	for _, ns := range namespaces {
-		if !ns.IsDir() {
+		if !ns.IsDir() || ns.Name() == "dry_run" {
 			continue
 		}
-
-		namespaceDir := filepath.Join(outputDir, ns.Name())
-		compareNamespaceDir := filepath.Join(compareDir, ns.Name())
-		files, err := ioutil.ReadDir(namespaceDir)
+		files, err := ioutil.ReadDir(filepath.Join(dir, ns.Name()))
 		if err != nil {
-			logError(fmt.Sprintf("Failed to read namespace directory %s: %v", namespaceDir, err))
-			continue
+			return nil, fmt.Errorf("failed to read namespace directory %s: %v", filepath.Join(dir, ns.Name()), err)
 		}
-
+		kindFiles[ns.Name()] = make(map[string]bool)
 		for _, file := range files {
-			outputFilePath := filepath.Join(namespaceDir, file.Name())
-			compareFilePath := filepath.Join(compareNamespaceDir, file.Name())
-
-			outputData, err := ioutil.ReadFile(outputFilePath)
-			if err != nil {
-				logError(fmt.Sprintf("Error reading output file %s: %v", outputFilePath, err))
-				continue
-			}
-
-			compareData, err := ioutil.ReadFile(compareFilePath)
-			if err != nil {
-				logError(fmt.Sprintf("Comparison file missing or unreadable: %s", compareFilePath))
-				continue
+			if !file.IsDir() && filepath.Ext(file.Name()) == ".json" {
+				kindFiles[ns.Name()][file.Name()] = true
 			}
+		}
+	}
+	return kindFiles, nil
+}
 
-			outputJSON, err := prettyPrintJSON(outputData)
-			if err != nil {
-				logError(fmt.Sprintf("Error formatting output JSON in file %s: %v", outputFilePath, err))
-				continue
+// unionKeys returns the sorted keys present in either map
+func unionKeys[V any](a, b map[string]V) []string {
+	seen := make(map[string]bool)
+	var keys []string
+	for _, m := range []map[string]V{a, b} {
+		for k := range m {
+			if !seen[k] {
+				seen[k] = true
+				keys = append(keys, k)
 			}
-			compareJSON, err := prettyPrintJSON(compareData)
-			if err != nil {
-				logError(fmt.Sprintf("Error formatting comparison JSON in file %s: %v", compareFilePath, err))
-				continue
-			}
-
-			logInfo(fmt.Sprintf("Comparing file: %s", file.Name()))
-			displayLineDiff(outputJSON, compareJSON)
-			fmt.Println()
 		}
 	}
-	return nil
+	sort.Strings(keys)
+	return keys
 }
 
-// displayLineDiff compares two JSON strings line by line, highlighting differences in color.
-func displayLineDiff(outputJSON, compareJSON string) {
-	outputLines := strings.Split(outputJSON, "\n")
-	compareLines := strings.Split(compareJSON, "\n")
+// countEntityChanges matches the entities of two kind files by parent and ID and
+// records how many are unchanged, only present on one side or different. A nil side
+// stands for a kind file that does not exist there. Items moved inside order-insensitive
+// arrays are logged and counted, but do not make an entity different. With display the
+// differences of every entity are printed, one line per property or array item.
+func countEntityChanges(outputData, compareData []byte, kindRules *kindRules, kindSummary *KindSummary, display bool) error {
+	var outputEntities, compareEntities []OutputEntity
+	if outputData != nil {
+		if err := json.Unmarshal(outputData, &outputEntities); err != nil {
+			return fmt.Errorf("error unmarshalling output entities: %v", err)
+		}
+	}
+	if compareData != nil {
+		if err := json.Unmarshal(compareData, &compareEntities); err != nil {
+			return fmt.Errorf("error unmarshalling comparison entities: %v", err)
+		}
+	}
+
+	// Entities without an ID share a key, so every key holds a queue of candidates
+	remote := make(map[string][]OutputEntity)
+	for _, entity := range outputEntities {
+		remote[entityKeyString(entity)] = append(remote[entityKeyString(entity)], entity)
+	}
 
+	fields := []any{"namespace", kindSummary.Namespace, "kind", kindSummary.Kind}
 	added, deleted, changed := 0, 0, 0
-	for i := 0; i < len(outputLines) || i < len(compareLines); i++ {
-		var outputLine, compareLine string
-		if i < len(outputLines) {
-			outputLine = outputLines[i]
+	for _, entity := range compareEntities {
+		key := entityKeyString(entity)
+		candidates := remote[key]
+		if len(candidates) == 0 {
+			kindSummary.Created++
+			if display {
+				logDiff("ADDED", "entity "+key, colorGreen, fields...)
+				added++
+			}
+			continue
 		}
-		if i < len(compareLines) {
-			compareLine = compareLines[i]
+		existing := candidates[0]
+		remote[key] = candidates[1:]
+
+		if moves := kindRules.arrayMoves(existing.Data, entity.Data); len(moves) > 0 {
+			if display {
+				for _, move := range moves {
+					logDiff("MOVED", fmt.Sprintf("entity %s: %s", key, move), colorCyan, fields...)
+				}
+			}
+			kindSummary.Moved++
 		}
 
-		if outputLine != compareLine {
-			if compareLine == "" {
-				logDiff("ADDED", outputLine, colorGreen)
-				fmt.Printf("\n%sLine: %d%s\n", colorGreen, i+3, colorReset)
+		changes := kindRules.dataChanges(existing.Data, entity.Data)
+		if len(changes) == 0 {
+			kindSummary.Unchanged++
+			continue
+		}
+		kindSummary.Updated++
+		if !display {
+			continue
+		}
+		for _, change := range changes {
+			label := fmt.Sprintf("entity %s: %s", key, change.Path)
+			switch change.Action {
+			case "added":
+				logDiff("ADDED", fmt.Sprintf("%s %s", label, shortJSON(change.After)), colorGreen, fields...)
 				added++
-			} else if outputLine == "" {
-				logDiff("DELETED", compareLine, colorRed)
-				fmt.Printf("\n%sLine: %d%s\n", colorRed, i+3, colorReset)
+			case "removed":
+				logDiff("DELETED", fmt.Sprintf("%s %s", label, shortJSON(change.Before)), colorRed, fields...)
 				deleted++
-			} else {
-				logDiff("CHANGED", fmt.Sprintf("Expected: %s", compareLine), colorRed)
-				logDiff("\nCHANGED", fmt.Sprintf("Got:      %s", outputLine), colorYellow)
-				fmt.Printf("\n%sLine: %d%s\n", colorRed, i+3, colorReset)
+			default:
+				logDiff("CHANGED", fmt.Sprintf("%s %s -> %s", label, shortJSON(change.Before), shortJSON(change.After)), colorYellow, fields...)
 				changed++
 			}
 		}
 	}
+	for _, key := range sortedKeys(remote) {
+		kindSummary.Deleted += len(remote[key])
+		if display {
+			for range remote[key] {
+				logDiff("DELETED", "entity "+key, colorRed, fields...)
+				deleted++
+			}
+		}
+	}
 
-	// Summary of differences
-	fmt.Printf("\n%sSummary: %d added, %d deleted, %d changed%s\n\n",
-		colorBlue, added, deleted, changed, colorReset)
-}
-
-// logDiff formats and colors diff messages based on type.
-func logDiff(changeType, message, colorCode string) {
-	fmt.Printf("%s%s: %s%s", colorCode, changeType, message, colorReset)
+	switch {
+	case display && logAsJSON:
+		logInfo("Differences", append(fields, "added", added, "deleted", deleted, "changed", changed)...)
+	case display:
+		// Summary of differences
+		fmt.Printf("%sSummary: %d added, %d deleted, %d changed%s\n\n", colorBlue, added, deleted, changed, colorReset)
+	}
+	return nil
 }
 
-// prettyPrintJSON formats JSON data to a pretty-printed string with consistent formatting.
-func prettyPrintJSON(data []byte) (string, error) {
-	var obj interface{}
-	if err := json.Unmarshal(data, &obj); err != nil {
-		return "", fmt.Errorf("error unmarshalling JSON: %v", err)
-	}
-	prettyData, err := json.MarshalIndent(obj, "", "  ")
-	if err != nil {
-		return "", fmt.Errorf("error formatting JSON: %v", err)
+// logDiff prints one difference of a compare, coloured by its type, or logs it as a record
+// with the fields attached when logging JSON
+func logDiff(changeType, message, colorCode string, fields ...any) {
+	if logAsJSON {
+		logInfo(message, append([]any{"change", changeType}, fields...)...)
+		return
 	}
-	return string(prettyData), nil
+	fmt.Printf("%s%s: %s%s\n", colorCode, changeType, message, colorReset)
 }
@@ -0,0 +1,457 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+
+	"paven-go/dsvalue"
+)
+
+// dryRunDir receives the entities a dry-run apply would write
+const dryRunDir = "local_changes/dry_run"
+
+// planPath is where apply saves the last plan built from the changes directory applyDir
+func planPath(applyDir string) string {
+	return filepath.Join(applyDir, "plan.json")
+}
+
+// Decisions recorded for every planned change
+const (
+	decisionPending  = "pending"
+	decisionAccepted = "accepted"
+	decisionSkipped  = "skipped"
+)
+
+// PlannedChange is one entity that differs between the changes directory and Datastore
+type PlannedChange struct {
+	Namespace string                 `json:"namespace"`
+	Kind      string                 `json:"kind"`
+	ID        string                 `json:"id"`
+	Parent    string                 `json:"parent,omitempty"`
+	Action    string                 `json:"action"` // "created" or "updated"
+	Before    map[string]interface{} `json:"before,omitempty"`
+	After     map[string]interface{} `json:"after"`
+	Diff      []string               `json:"diff"`
+	Decision  string                 `json:"decision"`
+	Edited    bool                   `json:"edited,omitempty"`
+	Document  string                 `json:"document,omitempty"` // file of the document setting one of its properties
+	Result    string                 `json:"result,omitempty"`
+}
+
+// Plan lists every change an apply of a changes directory would make
+type Plan struct {
+	Project   string           `json:"project"`
+	Source    string           `json:"source"`
+	CreatedAt time.Time        `json:"createdAt"`
+	Changes   []*PlannedChange `json:"changes"`
+
+	// unchanged holds the entities of the kind files counted as unchanged, by plannedKey
+	unchanged map[string]bool
+}
+
+// plannedKey identifies an entity of the plan across namespaces and kinds
+func plannedKey(namespace, kind, parent, id string) string {
+	return strings.Join([]string{namespace, kind, parent, id}, "\x00")
+}
+
+// applyOptions controls how applyChangesToDatabase treats the planned changes
+type applyOptions struct {
+	DryRun bool
+	Review bool
+	// Merge applies the kind files as JSON merge patches on the current entities
+	Merge bool
+	// BaseDir holds the downloaded data the references of the changes are resolved against
+	BaseDir string
+	// Only restricts the plan to the matching changes, all changes are kept when nil
+	Only func(change *PlannedChange) bool
+}
+
+// buildPlan reads the kind files in applyDir, fetches the current version of every entity and
+// returns the entities that would be created or updated. Unchanged entities and files or entities
+// that cannot be read are counted in summary; the latter are logged and skipped.
+// With merge the data of every entity is a JSON merge patch (RFC 7396) on its current version:
+// properties left out keep their value and null properties are removed.
+func buildPlan(ctx context.Context, client *datastore.Client, config Config, applyDir string, merge bool, summary *RunSummary) (*Plan, error) {
+	projectID := config.ProjectID
+	rules, err := newDiffRules(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid comparison rules: %v", err)
+	}
+
+	namespaces, err := ioutil.ReadDir(applyDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read apply directory: %v", err)
+	}
+
+	plan := &Plan{Project: projectID, Source: applyDir, CreatedAt: time.Now().UTC(), unchanged: make(map[string]bool)}
+	for _, ns := range namespaces {
+		if ns.Name() == "dry_run" || !ns.IsDir() {
+			continue
+		}
+
+		namespaceDir := filepath.Join(applyDir, ns.Name())
+		files, err := ioutil.ReadDir(namespaceDir)
+		if err != nil {
+			logError(fmt.Sprintf("Failed to read namespace directory %s: %v", namespaceDir, err), "project", projectID, "namespace", ns.Name())
+			summary.Kind(ns.Name(), "*").Failed++
+			continue
+		}
+
+		for _, file := range files {
+			kind := strings.TrimSuffix(file.Name(), filepath.Ext(file.Name()))
+			filePath := filepath.Join(namespaceDir, file.Name())
+			kindSummary := summary.Kind(ns.Name(), kind)
+			kindRules := rules.forKind(ns.Name(), kind)
+
+			data, err := ioutil.ReadFile(filePath)
+			if err != nil {
+				logError(fmt.Sprintf("Error reading file %s: %v", filePath, err), "project", projectID, "namespace", ns.Name(), "kind", kind)
+				kindSummary.Failed++
+				continue
+			}
+
+			var entities []OutputEntity
+			if err := json.Unmarshal(data, &entities); err != nil {
+				logError(fmt.Sprintf("Error unmarshalling JSON in file %s: %v", filePath, err), "project", projectID, "namespace", ns.Name(), "kind", kind)
+				kindSummary.Failed++
+				continue
+			}
+
+			// Loop through each entity in the JSON data to prepare for database actions
+			for _, entity := range entities {
+				fields := entityFields(projectID, ns.Name(), kind, entityKeyString(entity))
+				key, err := entityDatastoreKey(ns.Name(), kind, entity.ID, entity.Parent)
+				if err != nil {
+					logError(fmt.Sprintf("Invalid key for entity with ID %s in file %s: %v", entity.ID, filePath, err), fields...)
+					kindSummary.Failed++
+					continue
+				}
+
+				// Prepare the new data map for comparison or new entity creation
+				newDataMap := make(map[string]interface{})
+				for k, v := range entity.Data {
+					newDataMap[k] = dsvalue.Plain(v)
+				}
+
+				// Skip datastore fetch if entity.ID is empty (new entity)
+				var existingDataMap map[string]interface{}
+				isNew := entity.ID == ""
+				if !isNew {
+					var existingData datastore.PropertyList
+					err := client.Get(ctx, key, &existingData)
+					if err != nil && err != datastore.ErrNoSuchEntity {
+						logError(fmt.Sprintf("Error fetching entity with ID %s from Datastore: %v", entity.ID, err), fields...)
+						kindSummary.Failed++
+						continue
+					}
+					isNew = err == datastore.ErrNoSuchEntity
+					if !isNew {
+						existingDataMap = dsvalue.FromPropertyList(existingData)
+					}
+				}
+
+				if merge {
+					if isNew {
+						logWarn("Creating entity from a merge patch, only the properties in the file are set", fields...)
+					}
+					newDataMap = mergePatch(existingDataMap, newDataMap).(map[string]interface{})
+				}
+
+				// Ignored properties never count as a difference and may keep their remote value
+				if !isNew {
+					newDataMap = kindRules.preserveData(newDataMap, existingDataMap)
+				}
+				diff := kindRules.diffData(existingDataMap, newDataMap)
+				if !isNew && len(diff) == 0 {
+					logDebug("Entity unchanged", fields...)
+					kindSummary.Unchanged++
+					plan.unchanged[plannedKey(ns.Name(), kind, entity.Parent, entity.ID)] = true
+					continue
+				}
+
+				change := &PlannedChange{
+					Namespace: ns.Name(),
+					Kind:      kind,
+					ID:        entity.ID,
+					Parent:    entity.Parent,
+					Action:    "updated",
+					Before:    existingDataMap,
+					After:     newDataMap,
+					Diff:      diff,
+					Decision:  decisionPending,
+				}
+				if isNew {
+					change.Action = "created"
+				}
+				plan.Changes = append(plan.Changes, change)
+			}
+		}
+	}
+
+	if err := planDocuments(ctx, client, config, rules, applyDir, merge, plan, summary); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+// documentChanges returns a plan of the changes a document sets a property of
+func (p *Plan) documentChanges() *Plan {
+	documents := &Plan{Project: p.Project, Source: p.Source, CreatedAt: p.CreatedAt}
+	for _, change := range p.Changes {
+		if change.Document != "" {
+			documents.Changes = append(documents.Changes, change)
+		}
+	}
+	return documents
+}
+
+// filter drops the changes that do not match keep
+func (p *Plan) filter(keep func(change *PlannedChange) bool) {
+	var kept []*PlannedChange
+	for _, change := range p.Changes {
+		if keep(change) {
+			kept = append(kept, change)
+		}
+	}
+	p.Changes = kept
+}
+
+// acceptAll marks every pending change as accepted, which is what a plain apply does
+func (p *Plan) acceptAll() {
+	for _, change := range p.Changes {
+		if change.Decision == decisionPending {
+			change.Decision = decisionAccepted
+		}
+	}
+}
+
+// executePlan writes the accepted changes to Datastore, or to the dry_run directory in dry-run mode,
+// and records the outcome of each change in the plan. Every entity written outside dry-run mode is
+// appended to the audit log.
+func executePlan(ctx context.Context, client *datastore.Client, config Config, plan *Plan, dryRun bool, summary *RunSummary) error {
+	projectID := plan.Project
+	audit := newAuditLog(config.Audit, client, plan.Source)
+
+	if dryRun {
+		if _, err := os.Stat(dryRunDir); err == nil {
+			if err := os.RemoveAll(dryRunDir); err != nil {
+				return fmt.Errorf("failed to clear dry_run directory: %v", err)
+			}
+		}
+		if err := os.MkdirAll(dryRunDir, os.ModePerm); err != nil {
+			return fmt.Errorf("failed to create dry_run directory: %v", err)
+		}
+	}
+
+	// Dry-run entities grouped per namespace and kind, in the order they were planned
+	changesPerKind := make(map[[2]string][]datastore.Entity)
+	var kindOrder [][2]string
+
+	for _, change := range plan.Changes {
+		kindSummary := summary.Kind(change.Namespace, change.Kind)
+		fields := entityFields(projectID, change.Namespace, change.Kind, change.ID)
+
+		if change.Decision != decisionAccepted {
+			logInfo(fmt.Sprintf("Skipping entity with ID %s (%s)", change.ID, change.Decision), fields...)
+			kindSummary.Skipped++
+			continue
+		}
+
+		key, err := entityDatastoreKey(change.Namespace, change.Kind, change.ID, change.Parent)
+		if err != nil {
+			logError(fmt.Sprintf("Invalid key for entity with ID %s: %v", change.ID, err), fields...)
+			change.Result = "failed: " + err.Error()
+			kindSummary.Failed++
+			continue
+		}
+		properties, err := dsvalue.ToPropertyList(change.After)
+		if err != nil {
+			logError(fmt.Sprintf("Error converting data map for entity with ID %s: %v", change.ID, err), fields...)
+			change.Result = "failed: " + err.Error()
+			kindSummary.Failed++
+			continue
+		}
+
+		if dryRun {
+			// In dry-run mode, log all changes (including new entities)
+			logInfo(fmt.Sprintf("Dry-run: preparing entity for creation/update with ID %s", change.ID), append(fields, "differences", change.Diff)...)
+			group := [2]string{change.Namespace, change.Kind}
+			if _, ok := changesPerKind[group]; !ok {
+				kindOrder = append(kindOrder, group)
+			}
+			changesPerKind[group] = append(changesPerKind[group], datastore.Entity{
+				Key:        key,
+				Properties: properties,
+			})
+			change.Result = "dry-run"
+		} else {
+			logInfo(fmt.Sprintf("Applying updates for entity with ID %s", change.ID), fields...)
+			storedKey, err := client.Put(ctx, key, &properties)
+			if err != nil {
+				logError(fmt.Sprintf("Error applying entity with ID %s: %v", change.ID, err), fields...)
+				change.Result = "failed: " + err.Error()
+				kindSummary.Failed++
+				continue
+			}
+			logInfo(fmt.Sprintf("Updated entity with ID %s in Datastore", change.ID), fields...)
+			change.ID = getEntityID(storedKey)
+			change.Result = "applied"
+
+			record := AuditRecord{
+				Project:   projectID,
+				Namespace: change.Namespace,
+				Kind:      change.Kind,
+				ID:        change.ID,
+				Parent:    change.Parent,
+				Action:    change.Action,
+				Before:    change.Before,
+				After:     change.After,
+			}
+			if err := audit.Record(ctx, record); err != nil {
+				// The entity is written, but an apply without its audit entry is not a success
+				logError(fmt.Sprintf("Error recording audit entry for entity with ID %s: %v", change.ID, err), fields...)
+				change.Result = "failed: applied without an audit entry: " + err.Error()
+				kindSummary.Failed++
+				continue
+			}
+		}
+
+		if change.Action == "created" {
+			kindSummary.Created++
+		} else {
+			kindSummary.Updated++
+		}
+	}
+
+	// Write out a dry-run file for every kind with changes
+	for _, group := range kindOrder {
+		namespace, kind := group[0], group[1]
+		dryRunNamespaceDir := filepath.Join(dryRunDir, namespace)
+		if err := os.MkdirAll(dryRunNamespaceDir, os.ModePerm); err != nil {
+			return fmt.Errorf("failed to create namespace directory %s: %v", dryRunNamespaceDir, err)
+		}
+		dryRunFile := filepath.Join(dryRunNamespaceDir, fmt.Sprintf("%s_dry_run.json", kind))
+		jsonData, err := json.MarshalIndent(changesPerKind[group], "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to marshal dry-run output for kind %s: %v", kind, err)
+		}
+
+		if err := ioutil.WriteFile(dryRunFile, jsonData, 0644); err != nil {
+			return fmt.Errorf("failed to write dry-run JSON output for kind %s: %v", kind, err)
+		}
+		logInfo(fmt.Sprintf("Dry-run output saved to %s", dryRunFile), "project", projectID, "namespace", namespace, "kind", kind)
+	}
+
+	return nil
+}
+
+// savePlan writes the plan, including the decisions and results of its changes, as JSON
+func savePlan(plan *Plan, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create plan directory: %v", err)
+	}
+	jsonData, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal plan: %v", err)
+	}
+	if err := ioutil.WriteFile(path, jsonData, 0644); err != nil {
+		return fmt.Errorf("failed to write plan %s: %v", path, err)
+	}
+	return nil
+}
+
+// loadPlan reads a plan saved by savePlan
+func loadPlan(path string) (*Plan, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read plan %s: %v", path, err)
+	}
+	var plan Plan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return nil, fmt.Errorf("failed to parse plan %s: %v", path, err)
+	}
+	return &plan, nil
+}
+
+// entityDatastoreKey builds the Datastore key of an entity from its namespace, kind, ID and
+// "parentKind,parentID" parent. Numeric IDs become ID keys, anything else a name key, and an
+// empty ID an incomplete key so Datastore generates one.
+func entityDatastoreKey(namespace, kind, id, parent string) (*datastore.Key, error) {
+	var parentKey *datastore.Key
+
+	// Handle parent key creation
+	if parent != "" {
+		parentArr := strings.Split(parent, ",")
+		if len(parentArr) != 2 {
+			return nil, fmt.Errorf("parent %q is not in the kind,id format", parent)
+		}
+		if parentID, err := strconv.ParseInt(parentArr[1], 10, 64); err == nil {
+			parentKey = datastore.IDKey(parentArr[0], parentID, nil)
+		} else {
+			parentKey = datastore.NameKey(parentArr[0], parentArr[1], nil)
+		}
+		parentKey.Namespace = namespace
+	}
+
+	// Determine the appropriate key based on the ID presence
+	var key *datastore.Key
+	if id == "" {
+		key = datastore.IncompleteKey(kind, parentKey)
+	} else if idInt, err := strconv.ParseInt(id, 10, 64); err == nil {
+		key = datastore.IDKey(kind, idInt, parentKey)
+	} else {
+		key = datastore.NameKey(kind, id, parentKey)
+	}
+	key.Namespace = namespace
+	return key, nil
+}
+
+// propertyDiff lists the differences between two JSON-like values as one line per property
+// path, e.g. `steps[3].page: "a" -> "b"`. Arrays are compared by position; kindRules.diffData
+// matches the items of order-insensitive arrays by identity instead.
+func propertyDiff(path string, before, after interface{}) []string {
+	var diff []string
+	for _, change := range (&kindRules{}).changes(path, nil, before, after) {
+		diff = append(diff, change.String())
+	}
+	return diff
+}
+
+// mergePatch applies a JSON merge patch (RFC 7396) to a copy of target: objects are merged
+// property by property, null removes a property and any other value replaces the target
+func mergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return copyValue(patch)
+	}
+	result := make(map[string]interface{})
+	if targetObject, ok := target.(map[string]interface{}); ok {
+		result = copyValue(targetObject).(map[string]interface{})
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(result, name)
+			continue
+		}
+		result[name] = mergePatch(result[name], value)
+	}
+	return result
+}
+
+// shortJSON renders a value for diff lines, truncating large objects
+func shortJSON(value interface{}) string {
+	text := canonicalJSON(value)
+	if len(text) > 120 {
+		return text[:117] + "..."
+	}
+	return text
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+// parseJSON decodes a JSON literal of a test
+func parseJSON(t *testing.T, literal string) interface{} {
+	t.Helper()
+	var value interface{}
+	if err := json.Unmarshal([]byte(literal), &value); err != nil {
+		t.Fatalf("invalid test JSON %s: %v", literal, err)
+	}
+	return value
+}
+
+func TestMergePatch(t *testing.T) {
+	// Cases of RFC 7396, appendix A, and the shapes of the kind files
+	tests := []struct {
+		target, patch, want string
+	}{
+		{`{"a": "b"}`, `{"a": "c"}`, `{"a": "c"}`},
+		{`{"a": "b"}`, `{"b": "c"}`, `{"a": "b", "b": "c"}`},
+		{`{"a": "b"}`, `{"a": null}`, `{}`},
+		{`{"a": "b", "b": "c"}`, `{"a": null}`, `{"b": "c"}`},
+		{`{"a": ["b"]}`, `{"a": "c"}`, `{"a": "c"}`},
+		{`{"a": "c"}`, `{"a": ["b"]}`, `{"a": ["b"]}`},
+		{`{"a": {"b": "c"}}`, `{"a": {"b": "d", "c": null}}`, `{"a": {"b": "d"}}`},
+		{`{"a": [{"b": "c"}]}`, `{"a": [1]}`, `{"a": [1]}`},
+		{`["a", "b"]`, `["c", "d"]`, `["c", "d"]`},
+		{`{"a": "b"}`, `["c"]`, `["c"]`},
+		{`{"e": null}`, `{"a": 1}`, `{"e": null, "a": 1}`},
+		{`[1, 2]`, `{"a": "b", "c": null}`, `{"a": "b"}`},
+		{`{}`, `{"a": {"bb": {"ccc": null}}}`, `{"a": {"bb": {}}}`},
+		{`{"config": {"colors": {"background": "#FFFFFF", "text": "#000000"}, "cta": []}}`,
+			`{"config": {"colors": {"background": "#141414"}}}`,
+			`{"config": {"colors": {"background": "#141414", "text": "#000000"}, "cta": []}}`},
+	}
+	for _, test := range tests {
+		target := parseJSON(t, test.target)
+		got := mergePatch(target, parseJSON(t, test.patch))
+		if diff := deep.Equal(got, parseJSON(t, test.want)); diff != nil {
+			t.Errorf("merging %s into %s: %v", test.patch, test.target, diff)
+		}
+		if diff := deep.Equal(target, parseJSON(t, test.target)); diff != nil {
+			t.Errorf("merging %s changed the target %s: %v", test.patch, test.target, diff)
+		}
+	}
+}
+
+func TestPropertyDiff(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after string
+		want          []string
+	}{
+		{"equal", `{"a": 1, "b": [1, 2]}`, `{"b": [1, 2], "a": 1}`, nil},
+		{"whole numbers", `{"a": 1}`, `{"a": 1.0}`, nil},
+		{"changed", `{"title": "a"}`, `{"title": "b"}`, []string{`title: "a" -> "b"`}},
+		{"added and removed", `{"a": 1}`, `{"b": 2}`, []string{"a: removed 1", "b: added 2"}},
+		{"nested", `{"config": {"colors": {"background": "#FFFFFF"}}}`, `{"config": {"colors": {"background": "#000000"}}}`,
+			[]string{`config.colors.background: "#FFFFFF" -> "#000000"`}},
+		{"arrays by position", `{"steps": [{"page": "a"}, {"page": "b"}]}`, `{"steps": [{"page": "a"}, {"page": "c"}, {"page": "d"}]}`,
+			[]string{`steps[1].page: "b" -> "c"`, `steps[2]: added {"page":"d"}`}},
+		{"shorter array", `{"tags": ["a", "b"]}`, `{"tags": ["a"]}`, []string{`tags[1]: removed "b"`}},
+		{"type change", `{"a": {"b": 1}}`, `{"a": [1]}`, []string{`a: {"b":1} -> [1]`}},
+		{"null", `{"a": null}`, `{"a": 1}`, []string{"a: null -> 1"}},
+	}
+	for _, test := range tests {
+		got := propertyDiff("", parseJSON(t, test.before), parseJSON(t, test.after))
+		if diff := deep.Equal(got, test.want); diff != nil {
+			t.Errorf("%s: %v", test.name, diff)
+		}
+	}
+	if got := propertyDiff("data", "a", "b"); len(got) != 1 || got[0] != `data: "a" -> "b"` {
+		t.Errorf("scalar at a path: %v", got)
+	}
+}
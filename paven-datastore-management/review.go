@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/manifoldco/promptui"
+
+	"paven-go/dsvalue"
+)
+
+// Choices offered for every change during an interactive review
+const (
+	reviewAccept     = "Accept"
+	reviewSkip       = "Skip"
+	reviewEdit       = "Edit"
+	reviewAcceptRest = "Accept all remaining"
+	reviewSkipRest   = "Skip all remaining"
+)
+
+// reviewPlan walks through the planned changes one by one, shows their property level diff and
+// records whether the operator accepts, skips or edits each of them. An edited entity is checked
+// against its schema and the references of the changes in applyDir on top of baseDir, and cannot
+// be accepted until it passes.
+func reviewPlan(config Config, plan *Plan, baseDir, applyDir string) error {
+	rules, err := newDiffRules(config)
+	if err != nil {
+		return fmt.Errorf("invalid comparison rules: %v", err)
+	}
+
+	for i, change := range plan.Changes {
+		if change.Decision != decisionPending {
+			continue
+		}
+
+		problems := 0
+		for change.Decision == decisionPending {
+			displayChange(change, fmt.Sprintf("%d/%d", i+1, len(plan.Changes)))
+
+			prompt := promptui.Select{
+				Label: "Apply this change?",
+				Items: []string{reviewAccept, reviewSkip, reviewEdit, reviewAcceptRest, reviewSkipRest},
+				Templates: &promptui.SelectTemplates{
+					Selected: colorCyan + "Decision: {{ . }}" + colorReset,
+					Active:   colorGreen + "\U0001F4CC {{ . }}" + colorReset,
+					Inactive: colorYellow + "  {{ . }}" + colorReset,
+				},
+			}
+			_, choice, err := prompt.Run()
+			if err != nil {
+				return fmt.Errorf("prompt failed: %v", err)
+			}
+
+			switch choice {
+			case reviewAccept:
+				if problems > 0 {
+					logError(fmt.Sprintf("The edited entity has %d problems, edit it again or skip it", problems))
+					continue
+				}
+				change.Decision = decisionAccepted
+			case reviewSkip:
+				change.Decision = decisionSkipped
+			case reviewEdit:
+				edited, err := editInEditor(change.After)
+				if err != nil {
+					logError(fmt.Sprintf("Edit discarded: %v", err))
+					continue
+				}
+				kindRules := rules.forKind(change.Namespace, change.Kind)
+				change.After = edited
+				change.Edited = true
+				change.Diff = kindRules.diffData(change.Before, edited)
+				if problems, err = checkEdit(config, change, baseDir, applyDir); err != nil {
+					return err
+				}
+				if problems > 0 {
+					logError(fmt.Sprintf("The edited entity has %d problems, edit it again or skip it", problems))
+				}
+			case reviewAcceptRest, reviewSkipRest:
+				decision := decisionAccepted
+				if choice == reviewSkipRest {
+					decision = decisionSkipped
+				} else if problems > 0 {
+					logError(fmt.Sprintf("The edited entity has %d problems, edit it again or skip it", problems))
+					continue
+				}
+				for _, rest := range plan.Changes[i:] {
+					if rest.Decision == decisionPending {
+						rest.Decision = decision
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkEdit validates the edited entity of a change against the schema of its kind and lints the
+// references with it in place of its version in applyDir or baseDir. It returns the number of
+// schema violations and dangling references, which are logged.
+func checkEdit(config Config, change *PlannedChange, baseDir, applyDir string) (int, error) {
+	violations, err := validatePlan(config, &Plan{Changes: []*PlannedChange{change}})
+	if err != nil {
+		return 0, fmt.Errorf("failed to validate the edited entity: %v", err)
+	}
+	if len(config.References) == 0 {
+		return len(violations), nil
+	}
+
+	data, err := loadLintData(baseDir, applyDir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to lint the edited entity: %v", err)
+	}
+	if data[change.Namespace] == nil {
+		data[change.Namespace] = make(map[string][]*lintEntity)
+	}
+	entity := OutputEntity{ID: change.ID, Parent: change.Parent, Data: change.After}
+	edited := &lintEntity{entity: entity, value: entityValue(entity), file: "edited"}
+	entities := data[change.Namespace][change.Kind]
+	replaced := false
+	for i, le := range entities {
+		if entityKeyString(le.entity) == entityKeyString(entity) {
+			entities[i], replaced = edited, true
+		}
+	}
+	if !replaced {
+		entities = append(entities, edited)
+	}
+	data[change.Namespace][change.Kind] = entities
+
+	dangling, err := lintReferences(config, data, newRunSummary())
+	if err != nil {
+		return 0, fmt.Errorf("failed to lint the edited entity: %v", err)
+	}
+	return len(violations) + dangling, nil
+}
+
+// displayChange prints the header and property level diff of a planned change
+func displayChange(change *PlannedChange, position string) {
+	fmt.Printf("\n%s[%s] %s %s/%s %s", colorBlue, position, strings.ToUpper(change.Action), change.Namespace, change.Kind, change.ID)
+	if change.Parent != "" {
+		fmt.Printf(" (parent %s)", change.Parent)
+	}
+	if change.Edited {
+		fmt.Print(" (edited)")
+	}
+	fmt.Println(colorReset)
+
+	if len(change.Diff) == 0 {
+		fmt.Println(colorYellow + "  no differences left after editing" + colorReset)
+	}
+	for _, line := range change.Diff {
+		color := colorYellow
+		if strings.Contains(line, ": added ") {
+			color = colorGreen
+		} else if strings.Contains(line, ": removed ") {
+			color = colorRed
+		}
+		fmt.Printf("%s  %s%s\n", color, line, colorReset)
+	}
+	fmt.Println()
+}
+
+// editInEditor opens the data of an entity in $EDITOR (vi by default) and returns the edited data
+func editInEditor(data map[string]interface{}) (map[string]interface{}, error) {
+	tmpFile, err := ioutil.TempFile("", "paven-entity-*.json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temporary file: %v", err)
+	}
+	defer os.Remove(tmpFile.Name())
+
+	jsonData, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		tmpFile.Close()
+		return nil, fmt.Errorf("failed to marshal entity data: %v", err)
+	}
+	if _, err := tmpFile.Write(jsonData); err != nil {
+		tmpFile.Close()
+		return nil, fmt.Errorf("failed to write temporary file: %v", err)
+	}
+	tmpFile.Close()
+
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+	cmd := exec.Command("sh", "-c", editor+` "$1"`, "editor", tmpFile.Name())
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("editor %s failed: %v", editor, err)
+	}
+
+	editedData, err := ioutil.ReadFile(tmpFile.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read edited file: %v", err)
+	}
+	var edited map[string]interface{}
+	if err := json.Unmarshal(editedData, &edited); err != nil {
+		return nil, fmt.Errorf("edited data is not a valid JSON object: %v", err)
+	}
+	return dsvalue.Plain(edited).(map[string]interface{}), nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckEdit(t *testing.T) {
+	dir := t.TempDir()
+	baseDir := filepath.Join(dir, "output")
+	applyDir := filepath.Join(dir, "local_changes")
+	schemasDir := filepath.Join(dir, "schemas")
+	files := map[string]string{
+		filepath.Join(baseDir, "ns", "goalsConfig.json"): `[{"id": "g1", "data": {"name": "buy car"}}]`,
+		filepath.Join(applyDir, "ns", "variables.json"):  `[{"id": "v1", "parent": "goalsConfig,g1", "data": {"value": 1, "goal": "buy car"}}]`,
+		filepath.Join(schemasDir, "variables.json"):      `{"type": "object", "properties": {"value": {"type": "number"}}}`,
+	}
+	for path, content := range files {
+		if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := Config{
+		SchemasDir: schemasDir,
+		References: []ReferenceConfig{{Kind: "variables", Path: "data.goal", Target: "goalsConfig", TargetField: "data.name"}},
+	}
+
+	tests := []struct {
+		name  string
+		after map[string]interface{}
+		want  int
+	}{
+		{"valid edit", map[string]interface{}{"value": int64(2), "goal": "buy car"}, 0},
+		{"schema violation", map[string]interface{}{"value": "two", "goal": "buy car"}, 1},
+		{"dangling reference", map[string]interface{}{"value": int64(2), "goal": "buy a car"}, 1},
+		{"both", map[string]interface{}{"value": "two", "goal": "buy a car"}, 2},
+	}
+	for _, test := range tests {
+		change := &PlannedChange{Namespace: "ns", Kind: "variables", ID: "v1", Parent: "goalsConfig,g1", Action: "updated", After: test.after}
+		got, err := checkEdit(config, change, baseDir, applyDir)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if got != test.want {
+			t.Errorf("%s: got %d problems, want %d", test.name, got, test.want)
+		}
+	}
+}
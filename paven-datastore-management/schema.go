@@ -0,0 +1,476 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"paven-go/dsvalue"
+)
+
+// defaultSchemasDir is used when the config does not set schemasDir
+const defaultSchemasDir = "./schemas"
+
+// jsonSchema is a parsed JSON Schema document. The validator supports the keywords used by the
+// kind schemas: $ref (local), type, enum, const, properties, required, additionalProperties,
+// items, minItems, maxItems, minimum, maximum, exclusiveMinimum, exclusiveMaximum, multipleOf,
+// minLength, maxLength, pattern, allOf, anyOf, oneOf and not. Other keywords are ignored.
+type jsonSchema struct {
+	root     map[string]interface{}
+	patterns map[string]*regexp.Regexp
+}
+
+// parseSchema parses a JSON Schema document
+func parseSchema(data []byte) (*jsonSchema, error) {
+	var root map[string]interface{}
+	if err := json.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("invalid JSON: %v", err)
+	}
+	return &jsonSchema{root: root, patterns: make(map[string]*regexp.Regexp)}, nil
+}
+
+// Validate checks value against the schema and returns one "path: message" line per violation
+func (s *jsonSchema) Validate(path string, value interface{}) []string {
+	return s.validate(path, s.root, value)
+}
+
+func (s *jsonSchema) validate(path string, schema interface{}, value interface{}) []string {
+	switch schema := schema.(type) {
+	case bool:
+		if !schema {
+			return []string{fmt.Sprintf("%s: not allowed", path)}
+		}
+		return nil
+	case map[string]interface{}:
+		return s.validateObject(path, schema, value)
+	default:
+		return []string{fmt.Sprintf("%s: invalid schema %s", path, shortJSON(schema))}
+	}
+}
+
+func (s *jsonSchema) validateObject(path string, schema map[string]interface{}, value interface{}) []string {
+	if ref, ok := schema["$ref"].(string); ok {
+		target, err := s.resolve(ref)
+		if err != nil {
+			return []string{fmt.Sprintf("%s: %v", path, err)}
+		}
+		return s.validate(path, target, value)
+	}
+
+	if types, ok := schema["type"]; ok {
+		if !matchesType(types, value) {
+			return []string{fmt.Sprintf("%s: expected %s, got %s", path, typeList(types), jsonType(value))}
+		}
+	}
+
+	var errs []string
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if canonicalJSON(allowed) == canonicalJSON(value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			errs = append(errs, fmt.Sprintf("%s: %s is not one of %s", path, shortJSON(value), shortJSON(enum)))
+		}
+	}
+	if constant, ok := schema["const"]; ok && canonicalJSON(constant) != canonicalJSON(value) {
+		errs = append(errs, fmt.Sprintf("%s: must be %s", path, shortJSON(constant)))
+	}
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		errs = append(errs, s.validateProperties(path, schema, value)...)
+	case []interface{}:
+		if min, ok := schemaNumber(schema, "minItems"); ok && float64(len(value)) < min {
+			errs = append(errs, fmt.Sprintf("%s: expected at least %v items, got %d", path, min, len(value)))
+		}
+		if max, ok := schemaNumber(schema, "maxItems"); ok && float64(len(value)) > max {
+			errs = append(errs, fmt.Sprintf("%s: expected at most %v items, got %d", path, max, len(value)))
+		}
+		if items, ok := schema["items"]; ok {
+			for i, item := range value {
+				errs = append(errs, s.validate(fmt.Sprintf("%s[%d]", path, i), items, item)...)
+			}
+		}
+	case string:
+		length := float64(len([]rune(value)))
+		if min, ok := schemaNumber(schema, "minLength"); ok && length < min {
+			errs = append(errs, fmt.Sprintf("%s: expected at least %v characters", path, min))
+		}
+		if max, ok := schemaNumber(schema, "maxLength"); ok && length > max {
+			errs = append(errs, fmt.Sprintf("%s: expected at most %v characters", path, max))
+		}
+		if pattern, ok := schema["pattern"].(string); ok {
+			re, err := s.pattern(pattern)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", path, err))
+			} else if !re.MatchString(value) {
+				errs = append(errs, fmt.Sprintf("%s: %q does not match %s", path, value, pattern))
+			}
+		}
+	default:
+		if number, ok := toFloat(value); ok {
+			errs = append(errs, validateNumber(path, schema, number)...)
+		}
+	}
+
+	if allOf, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range allOf {
+			errs = append(errs, s.validate(path, sub, value)...)
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok {
+		if s.countMatches(path, anyOf, value) == 0 {
+			errs = append(errs, fmt.Sprintf("%s: does not match any of the allowed schemas", path))
+		}
+	}
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+		if matches := s.countMatches(path, oneOf, value); matches != 1 {
+			errs = append(errs, fmt.Sprintf("%s: matches %d of the allowed schemas instead of exactly one", path, matches))
+		}
+	}
+	if not, ok := schema["not"]; ok && len(s.validate(path, not, value)) == 0 {
+		errs = append(errs, fmt.Sprintf("%s: matches a schema it must not match", path))
+	}
+	return errs
+}
+
+func (s *jsonSchema) validateProperties(path string, schema map[string]interface{}, value map[string]interface{}) []string {
+	var errs []string
+	properties, _ := schema["properties"].(map[string]interface{})
+
+	if required, ok := schema["required"].([]interface{}); ok {
+		for _, name := range required {
+			if name, ok := name.(string); ok {
+				if _, present := value[name]; !present {
+					errs = append(errs, fmt.Sprintf("%s: missing required property", joinPath(path, name)))
+				}
+			}
+		}
+	}
+
+	keys := make([]string, 0, len(value))
+	for key := range value {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	additional, hasAdditional := schema["additionalProperties"]
+	for _, key := range keys {
+		childPath := joinPath(path, key)
+		if sub, ok := properties[key]; ok {
+			errs = append(errs, s.validate(childPath, sub, value[key])...)
+			continue
+		}
+		if !hasAdditional {
+			continue
+		}
+		if allowed, ok := additional.(bool); ok && !allowed {
+			errs = append(errs, fmt.Sprintf("%s: unknown property%s", childPath, suggestProperty(key, properties)))
+			continue
+		}
+		errs = append(errs, s.validate(childPath, additional, value[key])...)
+	}
+	return errs
+}
+
+func validateNumber(path string, schema map[string]interface{}, number float64) []string {
+	var errs []string
+	if min, ok := schemaNumber(schema, "minimum"); ok && number < min {
+		errs = append(errs, fmt.Sprintf("%s: %v is less than the minimum %v", path, number, min))
+	}
+	if max, ok := schemaNumber(schema, "maximum"); ok && number > max {
+		errs = append(errs, fmt.Sprintf("%s: %v is greater than the maximum %v", path, number, max))
+	}
+	if min, ok := schemaNumber(schema, "exclusiveMinimum"); ok && number <= min {
+		errs = append(errs, fmt.Sprintf("%s: %v must be greater than %v", path, number, min))
+	}
+	if max, ok := schemaNumber(schema, "exclusiveMaximum"); ok && number >= max {
+		errs = append(errs, fmt.Sprintf("%s: %v must be less than %v", path, number, max))
+	}
+	if step, ok := schemaNumber(schema, "multipleOf"); ok && step > 0 {
+		if quotient := number / step; math.Abs(quotient-math.Round(quotient)) > 1e-9 {
+			errs = append(errs, fmt.Sprintf("%s: %v is not a multiple of %v", path, number, step))
+		}
+	}
+	return errs
+}
+
+// countMatches returns how many of the schemas value is valid against
+func (s *jsonSchema) countMatches(path string, schemas []interface{}, value interface{}) int {
+	matches := 0
+	for _, sub := range schemas {
+		if len(s.validate(path, sub, value)) == 0 {
+			matches++
+		}
+	}
+	return matches
+}
+
+// resolve follows a local reference such as #/definitions/step
+func (s *jsonSchema) resolve(ref string) (interface{}, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("only local references are supported, got %q", ref)
+	}
+	var target interface{} = s.root
+	for _, token := range strings.Split(strings.TrimPrefix(strings.TrimPrefix(ref, "#"), "/"), "/") {
+		if token == "" {
+			continue
+		}
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		object, ok := target.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("unresolvable reference %q", ref)
+		}
+		if target, ok = object[token]; !ok {
+			return nil, fmt.Errorf("unresolvable reference %q", ref)
+		}
+	}
+	return target, nil
+}
+
+func (s *jsonSchema) pattern(pattern string) (*regexp.Regexp, error) {
+	if re, ok := s.patterns[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q in schema: %v", pattern, err)
+	}
+	s.patterns[pattern] = re
+	return re, nil
+}
+
+// matchesType reports whether value has the schema type, or one of the types of a list
+func matchesType(types interface{}, value interface{}) bool {
+	switch types := types.(type) {
+	case string:
+		actual := jsonType(value)
+		if types == "number" && actual == "integer" {
+			return true
+		}
+		return actual == types
+	case []interface{}:
+		for _, t := range types {
+			if matchesType(t, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func typeList(types interface{}) string {
+	if list, ok := types.([]interface{}); ok {
+		var names []string
+		for _, t := range list {
+			names = append(names, fmt.Sprint(t))
+		}
+		return strings.Join(names, " or ")
+	}
+	return fmt.Sprint(types)
+}
+
+// jsonType returns the JSON Schema type name of a decoded JSON value
+func jsonType(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		if number, ok := toFloat(value); ok {
+			if number == math.Trunc(number) {
+				return "integer"
+			}
+			return "number"
+		}
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+func schemaNumber(schema map[string]interface{}, keyword string) (float64, bool) {
+	value, ok := schema[keyword]
+	if !ok {
+		return 0, false
+	}
+	return toFloat(value)
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// suggestProperty points at a declared property that differs from key only by a small typo
+func suggestProperty(key string, properties map[string]interface{}) string {
+	best, bestDistance := "", 3
+	for _, name := range sortedKeys(properties) {
+		if distance := editDistance(strings.ToLower(key), strings.ToLower(name)); distance < bestDistance {
+			best, bestDistance = name, distance
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (did you mean %s?)", best)
+}
+
+// editDistance is the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+// schemaSet loads the schema of each kind from the schemas directory on first use.
+// A namespace specific schemas/<namespace>/<kind>.json wins over schemas/<kind>.json.
+type schemaSet struct {
+	dir     string
+	schemas map[string]*jsonSchema
+}
+
+func newSchemaSet(config Config) *schemaSet {
+	dir := config.SchemasDir
+	if dir == "" {
+		dir = defaultSchemasDir
+	}
+	return &schemaSet{dir: dir, schemas: make(map[string]*jsonSchema)}
+}
+
+// forKind returns the schema of the kind, or nil when the kind has none
+func (s *schemaSet) forKind(namespace, kind string) (*jsonSchema, error) {
+	id := namespace + "/" + kind
+	if schema, ok := s.schemas[id]; ok {
+		return schema, nil
+	}
+
+	var schema *jsonSchema
+	for _, path := range []string{filepath.Join(s.dir, namespace, kind+".json"), filepath.Join(s.dir, kind+".json")} {
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read schema %s: %v", path, err)
+		}
+		if schema, err = parseSchema(data); err != nil {
+			return nil, fmt.Errorf("schema %s: %v", path, err)
+		}
+		break
+	}
+	s.schemas[id] = schema
+	return schema, nil
+}
+
+// validateDir checks every entity in the kind files of dir against the schema of its kind. Every
+// violation is logged with its file, entity and property path, counted as a failure of the
+// entity's kind in summary and returned.
+func validateDir(config Config, dir string, summary *RunSummary) ([]string, error) {
+	schemas := newSchemaSet(config)
+	kindFiles, err := listKindFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var violations []string
+	for _, namespace := range sortedKeys(kindFiles) {
+		for _, fileName := range sortedKeys(kindFiles[namespace]) {
+			kind := strings.TrimSuffix(fileName, ".json")
+			kindSummary := summary.Kind(namespace, kind)
+			filePath := filepath.Join(dir, namespace, fileName)
+
+			schema, err := schemas.forKind(namespace, kind)
+			if err != nil {
+				return nil, err
+			}
+			if schema == nil {
+				logDebug(fmt.Sprintf("No schema for kind %s, skipping %s", kind, filePath), "namespace", namespace, "kind", kind)
+				continue
+			}
+
+			entities, err := readKindFile(filePath)
+			if err != nil {
+				message := err.Error()
+				logError(message, "namespace", namespace, "kind", kind)
+				violations = append(violations, message)
+				kindSummary.Failed++
+				continue
+			}
+
+			for i, entity := range entities {
+				key := entityKeyString(entity)
+				if key == "" {
+					key = "#" + strconv.Itoa(i)
+				}
+				errs := schema.Validate("data", dsvalue.Plain(map[string]interface{}(entity.Data)))
+				if len(errs) == 0 {
+					continue
+				}
+				kindSummary.Failed++
+				for _, e := range errs {
+					message := fmt.Sprintf("%s: entity %s: %s", filePath, key, e)
+					logError(message, entityFields(config.ProjectID, namespace, kind, key)...)
+					violations = append(violations, message)
+				}
+			}
+		}
+	}
+	return violations, nil
+}
+
+// validatePlan checks the data every planned change would write against the schema of its kind,
+// for changes whose kind files do not hold whole entities, such as merge patches
+func validatePlan(config Config, plan *Plan) ([]string, error) {
+	schemas := newSchemaSet(config)
+	var violations []string
+	for _, change := range plan.Changes {
+		schema, err := schemas.forKind(change.Namespace, change.Kind)
+		if err != nil {
+			return nil, err
+		}
+		if schema == nil {
+			continue
+		}
+		key := entityKeyString(OutputEntity{ID: change.ID, Parent: change.Parent})
+		// Values fetched from Datastore are compared in the form they are downloaded in
+		for _, e := range schema.Validate("data", dsvalue.ToJSON(change.After)) {
+			message := fmt.Sprintf("merged entity %s: %s", key, e)
+			logError(message, entityFields(config.ProjectID, change.Namespace, change.Kind, key)...)
+			violations = append(violations, message)
+		}
+	}
+	return violations, nil
+}
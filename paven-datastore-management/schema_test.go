@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestSchemaValidate(t *testing.T) {
+	schema, err := parseSchema([]byte(`{
+		"type": "object",
+		"required": ["id"],
+		"additionalProperties": false,
+		"properties": {
+			"id": {"type": "string"},
+			"type": {"enum": ["button", "link"]},
+			"order": {"type": "integer", "minimum": 1, "maximum": 10},
+			"ratio": {"type": "number", "exclusiveMaximum": 1},
+			"labels": {"type": "object", "additionalProperties": {"type": "string"}},
+			"steps": {"type": "array", "items": {"$ref": "#/definitions/step"}}
+		},
+		"definitions": {
+			"step": {"type": "object", "required": ["page"], "properties": {"page": {"type": "string"}}}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		value map[string]interface{}
+		want  []string
+	}{
+		{"valid", map[string]interface{}{"id": "a", "type": "link", "order": int64(1), "ratio": 0.5, "labels": map[string]interface{}{"en": "x"}}, nil},
+		{"missing required", map[string]interface{}{}, []string{"data.id: missing required property"}},
+		{"unknown property", map[string]interface{}{"id": "a", "titel": "x"}, []string{"data.titel: unknown property"}},
+		{"additional properties schema", map[string]interface{}{"id": "a", "labels": map[string]interface{}{"en": int64(1)}},
+			[]string{"data.labels.en: expected string, got integer"}},
+		{"enum", map[string]interface{}{"id": "a", "type": "banner"}, []string{`data.type: "banner" is not one of ["button","link"]`}},
+		{"below minimum", map[string]interface{}{"id": "a", "order": int64(0)}, []string{"data.order: 0 is less than the minimum 1"}},
+		{"above maximum", map[string]interface{}{"id": "a", "order": int64(11)}, []string{"data.order: 11 is greater than the maximum 10"}},
+		{"exclusive maximum", map[string]interface{}{"id": "a", "ratio": 1.0}, []string{"data.ratio: 1 must be less than 1"}},
+		{"not an integer", map[string]interface{}{"id": "a", "order": 1.5}, []string{"data.order: expected integer, got number"}},
+		{"reference", map[string]interface{}{"id": "a", "steps": []interface{}{map[string]interface{}{}}},
+			[]string{"data.steps[0].page: missing required property"}},
+	}
+	for _, test := range tests {
+		if diff := deep.Equal(schema.Validate("data", test.value), test.want); diff != nil {
+			t.Errorf("%s: %v", test.name, diff)
+		}
+	}
+}
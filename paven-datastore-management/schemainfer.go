@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"paven-go/dsvalue"
+)
+
+// Limits for turning the strings seen at a path into an enum: few distinct, short values,
+// each seen on average at least twice (element types rather than titles or URLs)
+const (
+	inferMaxEnumValues = 20
+	inferMaxEnumLength = 40
+)
+
+// inferNode accumulates every value seen at one path of the inferred schema
+type inferNode struct {
+	types map[string]int
+
+	objects    int
+	properties map[string]*inferNode
+
+	items *inferNode
+
+	strings   map[string]int
+	enumBroke bool
+
+	min, max float64
+	numbers  int
+}
+
+func newInferNode() *inferNode {
+	return &inferNode{types: make(map[string]int), properties: make(map[string]*inferNode), strings: make(map[string]int)}
+}
+
+// add records one value
+func (n *inferNode) add(value interface{}) {
+	valueType := jsonType(value)
+	n.types[valueType]++
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		n.objects++
+		for key, child := range value {
+			node, ok := n.properties[key]
+			if !ok {
+				node = newInferNode()
+				n.properties[key] = node
+			}
+			node.add(child)
+		}
+	case []interface{}:
+		if n.items == nil {
+			n.items = newInferNode()
+		}
+		for _, item := range value {
+			n.items.add(item)
+		}
+	case string:
+		if n.enumBroke {
+			return
+		}
+		if len(value) > inferMaxEnumLength {
+			n.enumBroke = true
+			return
+		}
+		n.strings[value]++
+		if len(n.strings) > inferMaxEnumValues {
+			n.enumBroke = true
+		}
+	default:
+		if number, ok := toFloat(value); ok {
+			if n.numbers == 0 || number < n.min {
+				n.min = number
+			}
+			if n.numbers == 0 || number > n.max {
+				n.max = number
+			}
+			n.numbers++
+		}
+	}
+}
+
+// schema renders the accumulated values as a JSON Schema. Properties present in every object
+// are required and unknown properties are rejected, so typos show up when validating.
+func (n *inferNode) schema() map[string]interface{} {
+	schema := make(map[string]interface{})
+
+	var types []string
+	for t := range n.types {
+		if t == "integer" && n.types["number"] > 0 {
+			continue
+		}
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	if len(types) == 1 {
+		schema["type"] = types[0]
+	} else if len(types) > 1 {
+		schema["type"] = types
+	}
+
+	if n.objects > 0 {
+		properties := make(map[string]interface{})
+		var required []string
+		for _, key := range sortedKeys(n.properties) {
+			child := n.properties[key]
+			properties[key] = child.schema()
+			if child.total() == n.objects {
+				required = append(required, key)
+			}
+		}
+		schema["properties"] = properties
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+		schema["additionalProperties"] = false
+	}
+
+	if n.items != nil {
+		schema["items"] = n.items.schema()
+	}
+
+	if count := n.types["string"]; count > 0 && !n.enumBroke && count >= 2*len(n.strings) {
+		enum := make([]interface{}, 0, len(n.strings))
+		for _, value := range sortedKeys(n.strings) {
+			enum = append(enum, value)
+		}
+		if len(types) > 1 {
+			// The enum applies to the string values only
+			schema["anyOf"] = []interface{}{
+				map[string]interface{}{"type": "string", "enum": enum},
+				map[string]interface{}{"not": map[string]interface{}{"type": "string"}},
+			}
+		} else {
+			schema["enum"] = enum
+		}
+	}
+
+	if n.numbers > 0 {
+		schema["minimum"] = n.min
+		schema["maximum"] = n.max
+		if n.min == math.Trunc(n.min) && n.max == math.Trunc(n.max) {
+			schema["minimum"], schema["maximum"] = int64(n.min), int64(n.max)
+		}
+	}
+	return schema
+}
+
+// total returns how many values were recorded
+func (n *inferNode) total() int {
+	total := 0
+	for _, count := range n.types {
+		total += count
+	}
+	return total
+}
+
+// inferSchema builds a JSON Schema for the data of a kind from the kind files in dir. target is
+// "kind" to read the kind from every namespace, or "namespace/kind" for a single namespace.
+func inferSchema(dir, target string) (map[string]interface{}, error) {
+	namespace, kind, found := strings.Cut(target, "/")
+	if !found {
+		namespace, kind = "", target
+	}
+
+	kindFiles, err := listKindFiles(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", dir, err)
+	}
+
+	root := newInferNode()
+	entities := 0
+	var sources []string
+	for _, ns := range sortedKeys(kindFiles) {
+		if (namespace != "" && ns != namespace) || !kindFiles[ns][kind+".json"] {
+			continue
+		}
+		filePath := filepath.Join(dir, ns, kind+".json")
+		kindEntities, err := readKindFile(filePath)
+		if err != nil {
+			return nil, err
+		}
+		for _, entity := range kindEntities {
+			root.add(dsvalue.Plain(map[string]interface{}(entity.Data)))
+		}
+		entities += len(kindEntities)
+		sources = append(sources, ns)
+	}
+	if entities == 0 {
+		return nil, fmt.Errorf("no entities of kind %s found in %s", target, dir)
+	}
+
+	schema := root.schema()
+	schema["$schema"] = "http://json-schema.org/draft-07/schema#"
+	schema["title"] = kind
+	schema["description"] = fmt.Sprintf("Inferred from %d entities in %s (%s), review before committing", entities, dir, strings.Join(sources, ", "))
+	return schema, nil
+}
+
+// writeInferredSchema writes the schema to path, or to stdout when path is "-". Existing schemas
+// are never overwritten since they are usually refined by hand.
+func writeInferredSchema(schema map[string]interface{}, path string) error {
+	jsonData, err := json.MarshalIndent(schema, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal schema: %v", err)
+	}
+	jsonData = append(jsonData, '\n')
+
+	if path == "-" {
+		_, err := os.Stdout.Write(jsonData)
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fmt.Errorf("%s already exists, remove it or pass another file (or - for stdout)", path)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create schema directory: %v", err)
+	}
+	if err := ioutil.WriteFile(path, jsonData, 0644); err != nil {
+		return fmt.Errorf("failed to write schema %s: %v", path, err)
+	}
+	return nil
+}
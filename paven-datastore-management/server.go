@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+//go:embed web/index.html
+var serverPage []byte
+
+// ansiCodes matches the colour codes stripped from log output sent to the browser
+var ansiCodes = regexp.MustCompile("\033\\[[0-9;]*m")
+
+// server exposes download, compare, plan and apply over a local HTTP API and serves the review page
+type server struct {
+	config    Config
+	outputDir string
+	applyDir  string
+
+	// mu serialises the operations, they share the output, dry_run and plan files
+	mu sync.Mutex
+}
+
+// serverChange is a planned change together with the fingerprint used to approve it
+type serverChange struct {
+	Fingerprint string `json:"fingerprint"`
+	*PlannedChange
+}
+
+// serverResult is the response of every API call
+type serverResult struct {
+	Summary []*KindSummary `json:"summary"`
+	Changes []serverChange `json:"changes,omitempty"`
+	Log     string         `json:"log"`
+	Error   string         `json:"error,omitempty"`
+}
+
+// applyRequest lists the fingerprints of the approved changes
+type applyRequest struct {
+	Fingerprints []string `json:"fingerprints"`
+	DryRun       bool     `json:"dryRun"`
+}
+
+// runServer serves the API and the review page on addr until the process is stopped
+func runServer(config Config, addr, outputDir, applyDir string) error {
+	s := &server{config: config, outputDir: outputDir, applyDir: applyDir}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handlePage)
+	mux.HandleFunc("/api/download", s.handleDownload)
+	mux.HandleFunc("/api/compare", s.handleCompare)
+	mux.HandleFunc("/api/plan", s.handlePlan)
+	mux.HandleFunc("/api/apply", s.handleApply)
+
+	logInfo(fmt.Sprintf("Serving the review page on http://%s", addr), "project", config.ProjectID)
+	return http.ListenAndServe(addr, checkHost(addr, mux))
+}
+
+// checkHost rejects requests for another host than addr, and cross-origin requests, so a page of
+// a DNS rebinding domain that resolves to this machine cannot call the API. A loopback address
+// also accepts the other loopback names with its port.
+func checkHost(addr string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowedHost(addr, r.Host) {
+			http.Error(w, fmt.Sprintf("host %q is not allowed, open http://%s", r.Host, addr), http.StatusForbidden)
+			return
+		}
+		if origin := r.Header.Get("Origin"); origin != "" && origin != "http://"+r.Host {
+			http.Error(w, fmt.Sprintf("origin %q is not allowed", origin), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// allowedHost tells whether the Host header of a request names the listen address
+func allowedHost(addr, host string) bool {
+	if strings.EqualFold(host, addr) {
+		return true
+	}
+	listenHost, listenPort, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	requestHost, requestPort, err := net.SplitHostPort(host)
+	if err != nil || requestPort != listenPort {
+		return false
+	}
+	loopback := func(name string) bool {
+		if strings.EqualFold(name, "localhost") {
+			return true
+		}
+		ip := net.ParseIP(name)
+		return ip != nil && ip.IsLoopback()
+	}
+	// An empty host listens on every interface, the page is still meant to be opened locally
+	return (listenHost == "" || loopback(listenHost)) && loopback(requestHost)
+}
+
+func (s *server) handlePage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(serverPage)
+}
+
+// handleDownload downloads the configured kinds into the output directory
+func (s *server) handleDownload(w http.ResponseWriter, r *http.Request) {
+	s.operation(w, r, func(summary *RunSummary) ([]*PlannedChange, error) {
+		return nil, retrieveAndSaveJSON(s.config, s.outputDir)
+	})
+}
+
+// handleCompare compares the output directory with the changes directory
+func (s *server) handleCompare(w http.ResponseWriter, r *http.Request) {
+	s.operation(w, r, func(summary *RunSummary) ([]*PlannedChange, error) {
+		return nil, compareOutput(s.config, s.outputDir, s.applyDir, summary)
+	})
+}
+
+// handlePlan returns the last saved plan on GET and builds a new one with a dry-run apply on POST
+func (s *server) handlePlan(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		result := serverResult{}
+		if _, err := os.Stat(planPath(s.applyDir)); err == nil {
+			plan, err := loadPlan(planPath(s.applyDir))
+			if err != nil {
+				result.Error = err.Error()
+			} else {
+				result.Changes = withFingerprints(plan.Changes)
+			}
+		}
+		writeResult(w, http.StatusOK, result)
+		return
+	}
+
+	s.operation(w, r, func(summary *RunSummary) ([]*PlannedChange, error) {
+		if err := applyChangesToDatabase(s.config, s.applyDir, applyOptions{DryRun: true, BaseDir: s.outputDir}, summary); err != nil {
+			return nil, err
+		}
+		plan, err := loadPlan(planPath(s.applyDir))
+		if err != nil {
+			return nil, err
+		}
+		return plan.Changes, nil
+	})
+}
+
+// handleApply applies the approved changes. The plan is rebuilt from the changes directory and
+// Datastore, and only changes whose fingerprint was approved are kept, so anything that changed
+// since the review is skipped instead of being written unseen.
+func (s *server) handleApply(w http.ResponseWriter, r *http.Request) {
+	var request applyRequest
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		if len(request.Fingerprints) == 0 {
+			http.Error(w, "no changes approved", http.StatusBadRequest)
+			return
+		}
+	}
+	approved := make(map[string]bool)
+	for _, fingerprint := range request.Fingerprints {
+		approved[fingerprint] = true
+	}
+
+	s.operation(w, r, func(summary *RunSummary) ([]*PlannedChange, error) {
+		opts := applyOptions{DryRun: request.DryRun, BaseDir: s.outputDir, Only: func(change *PlannedChange) bool {
+			if approved[changeFingerprint(change)] {
+				return true
+			}
+			key := entityKeyString(OutputEntity{ID: change.ID, Parent: change.Parent})
+			logInfo(fmt.Sprintf("Skipping %s, it is not approved or changed in Datastore or the changes directory since the review", key),
+				entityFields(s.config.ProjectID, change.Namespace, change.Kind, key)...)
+			return false
+		}}
+		if err := applyChangesToDatabase(s.config, s.applyDir, opts, summary); err != nil {
+			return nil, err
+		}
+		plan, err := loadPlan(planPath(s.applyDir))
+		if err != nil {
+			return nil, err
+		}
+		return plan.Changes, nil
+	})
+}
+
+// operation runs a state changing API call one at a time and responds with its summary, changes
+// and log output. Only JSON POST requests are accepted, which a cross-site form cannot send.
+func (s *server) operation(w http.ResponseWriter, r *http.Request, run func(summary *RunSummary) ([]*PlannedChange, error)) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		http.Error(w, "expected a JSON request", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var logs bytes.Buffer
+	setLogOutput(io.MultiWriter(os.Stdout, &logs))
+	defer setLogOutput(os.Stdout)
+
+	summary := newRunSummary()
+	changes, err := run(summary)
+	result := serverResult{Summary: summary.Kinds(), Changes: withFingerprints(changes)}
+	status := http.StatusOK
+	if err != nil {
+		logError(err.Error())
+		result.Error = err.Error()
+		status = http.StatusInternalServerError
+	}
+	result.Log = ansiCodes.ReplaceAllString(logs.String(), "")
+	writeResult(w, status, result)
+}
+
+func writeResult(w http.ResponseWriter, status int, result serverResult) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		logError(fmt.Sprintf("Failed to write response: %v", err))
+	}
+}
+
+func withFingerprints(changes []*PlannedChange) []serverChange {
+	var result []serverChange
+	for _, change := range changes {
+		result = append(result, serverChange{Fingerprint: changeFingerprint(change), PlannedChange: change})
+	}
+	return result
+}
+
+// changeFingerprint identifies a planned change by its entity, the data it was planned against
+// and the data it would write, so an approval does not carry over to an entity edited in
+// Datastore after the review
+func changeFingerprint(change *PlannedChange) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		change.Namespace, change.Kind, change.Parent, change.ID, canonicalJSON(change.Before), canonicalJSON(change.After),
+	}, "\x00")))
+	return hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestAllowedHost(t *testing.T) {
+	tests := []struct {
+		addr, host string
+		want       bool
+	}{
+		{"127.0.0.1:8080", "127.0.0.1:8080", true},
+		{"127.0.0.1:8080", "localhost:8080", true},
+		{"127.0.0.1:8080", "[::1]:8080", true},
+		{"127.0.0.1:8080", "localhost:9090", false},
+		{"127.0.0.1:8080", "attacker.example:8080", false},
+		{"127.0.0.1:8080", "attacker.example", false},
+		{":8080", "localhost:8080", true},
+		{":8080", "attacker.example:8080", false},
+		{"10.0.0.5:8080", "10.0.0.5:8080", true},
+		{"10.0.0.5:8080", "localhost:8080", false},
+		{"editor.internal:8080", "EDITOR.internal:8080", true},
+	}
+	for _, test := range tests {
+		if got := allowedHost(test.addr, test.host); got != test.want {
+			t.Errorf("allowedHost(%q, %q) = %v, want %v", test.addr, test.host, got, test.want)
+		}
+	}
+}
+
+func TestChangeFingerprintCoversBefore(t *testing.T) {
+	planned := &PlannedChange{Namespace: "ns", Kind: "goals", ID: "g1", Before: map[string]interface{}{"title": "a"}, After: map[string]interface{}{"title": "b"}}
+	edited := *planned
+	edited.Before = map[string]interface{}{"title": "edited in the console"}
+	if changeFingerprint(planned) == changeFingerprint(&edited) {
+		t.Error("a change planned against another version of the entity has the same fingerprint")
+	}
+}
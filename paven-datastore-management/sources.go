@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultSnapshotsDir is used when the config does not set snapshotsDir
+const defaultSnapshotsDir = "./snapshots"
+
+// EnvironmentConfig describes a named Datastore environment that can be downloaded on the fly.
+// Kinds defaults to the kinds of the main configuration.
+type EnvironmentConfig struct {
+	ProjectID string       `yaml:"projectID"`
+	Kinds     []KindConfig `yaml:"kinds"`
+}
+
+// environmentConfig returns the configuration used to download the named environment
+func environmentConfig(config Config, name string) (Config, error) {
+	env, ok := config.Environments[name]
+	if !ok {
+		return config, fmt.Errorf("unknown environment %q", name)
+	}
+	envConfig := config
+	envConfig.ProjectID = env.ProjectID
+	if len(env.Kinds) > 0 {
+		envConfig.Kinds = env.Kinds
+	}
+	return envConfig, nil
+}
+
+func snapshotsDir(config Config) string {
+	if config.SnapshotsDir == "" {
+		return defaultSnapshotsDir
+	}
+	return config.SnapshotsDir
+}
+
+// resolveSource turns a diff side into a local directory in the namespace/kind.json layout.
+// Supported forms are:
+//
+//	dir:<path> or <path>     a local directory
+//	snapshot:<name>          a directory saved by the snapshot command
+//	env:<name>               an environment from the config, downloaded into a temporary directory
+//	git:<rev>[:<path>]       a git revision of a changes directory (default ./local_changes)
+//
+// The returned cleanup function removes temporary directories and must always be called.
+func resolveSource(config Config, spec string) (string, func(), error) {
+	noop := func() {}
+	kind, value, found := strings.Cut(spec, ":")
+	if !found {
+		kind, value = "dir", spec
+	}
+
+	switch kind {
+	case "dir":
+		if _, err := os.Stat(value); err != nil {
+			return "", noop, fmt.Errorf("directory %s not found: %v", value, err)
+		}
+		return value, noop, nil
+
+	case "snapshot":
+		dir := filepath.Join(snapshotsDir(config), value)
+		if _, err := os.Stat(dir); err != nil {
+			return "", noop, fmt.Errorf("snapshot %s not found in %s", value, snapshotsDir(config))
+		}
+		return dir, noop, nil
+
+	case "env":
+		envConfig, err := environmentConfig(config, value)
+		if err != nil {
+			return "", noop, err
+		}
+		dir, err := ioutil.TempDir("", "paven-env-"+value+"-")
+		if err != nil {
+			return "", noop, fmt.Errorf("failed to create temporary directory: %v", err)
+		}
+		cleanup := func() { os.RemoveAll(dir) }
+		logInfo(fmt.Sprintf("Downloading environment %s (project %s)...", value, envConfig.ProjectID), "project", envConfig.ProjectID)
+		if err := retrieveAndSaveJSON(envConfig, dir); err != nil {
+			cleanup()
+			return "", noop, fmt.Errorf("failed to download environment %s: %v", value, err)
+		}
+		return dir, cleanup, nil
+
+	case "git":
+		rev, path, _ := strings.Cut(value, ":")
+		if path == "" {
+			path = "./local_changes"
+		}
+		return checkoutGitRevision(rev, path)
+
+	default:
+		return "", noop, fmt.Errorf("unknown source type %q in %q (use dir, snapshot, env or git)", kind, spec)
+	}
+}
+
+// checkoutGitRevision copies the files of dir as they were at rev into a temporary directory
+func checkoutGitRevision(rev, dir string) (string, func(), error) {
+	noop := func() {}
+	prefix, err := exec.Command("git", "-C", dir, "rev-parse", "--show-prefix").Output()
+	if err != nil {
+		return "", noop, fmt.Errorf("%s is not inside a git work tree: %v", dir, err)
+	}
+	treePath := strings.TrimSpace(string(prefix))
+
+	out, err := exec.Command("git", "-C", dir, "ls-tree", "-r", "--name-only", "--full-tree", rev, "--", treePath).Output()
+	if err != nil {
+		return "", noop, fmt.Errorf("failed to list %s at revision %s: %v", dir, rev, err)
+	}
+
+	tmpDir, err := ioutil.TempDir("", "paven-git-")
+	if err != nil {
+		return "", noop, fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	cleanup := func() { os.RemoveAll(tmpDir) }
+
+	for _, name := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if name == "" {
+			continue
+		}
+		content, err := exec.Command("git", "-C", dir, "show", rev+":"+name).Output()
+		if err != nil {
+			cleanup()
+			return "", noop, fmt.Errorf("failed to read %s at revision %s: %v", name, rev, err)
+		}
+		target := filepath.Join(tmpDir, filepath.FromSlash(strings.TrimPrefix(name, treePath)))
+		if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+			cleanup()
+			return "", noop, fmt.Errorf("failed to create directory for %s: %v", target, err)
+		}
+		if err := ioutil.WriteFile(target, content, 0644); err != nil {
+			cleanup()
+			return "", noop, fmt.Errorf("failed to write %s: %v", target, err)
+		}
+	}
+	return tmpDir, cleanup, nil
+}
+
+// diffSources compares two sources with the same walk and counters as compareOutput
+func diffSources(config Config, left, right string, summary *RunSummary) error {
+	leftDir, cleanupLeft, err := resolveSource(config, left)
+	defer cleanupLeft()
+	if err != nil {
+		return fmt.Errorf("left side: %v", err)
+	}
+	rightDir, cleanupRight, err := resolveSource(config, right)
+	defer cleanupRight()
+	if err != nil {
+		return fmt.Errorf("right side: %v", err)
+	}
+
+	logInfo(fmt.Sprintf("Comparing %s with %s", left, right))
+	return compareOutput(config, leftDir, rightDir, summary)
+}
+
+// saveSnapshot downloads the configured kinds into a named snapshot directory,
+// named after the current time when no name is given
+func saveSnapshot(config Config, name string) (string, error) {
+	if name == "" {
+		name = time.Now().Format("2006-01-02T15-04-05")
+	}
+	dir := filepath.Join(snapshotsDir(config), name)
+	if _, err := os.Stat(dir); err == nil {
+		return "", fmt.Errorf("snapshot %s already exists", dir)
+	}
+	if err := retrieveAndSaveJSON(config, dir); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return dir, nil
+}
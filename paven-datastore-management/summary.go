@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// Exit codes returned by the tool so CI pipelines can gate on the outcome of a run
+const (
+	exitSuccess        = 0 // everything went fine and nothing differs
+	exitFatal          = 1 // the run could not complete (bad config, client errors, prompt failures)
+	exitDifferences    = 2 // compare found differences between the two sides
+	exitPartialFailure = 3 // the run completed but some files or entities failed
+)
+
+// KindSummary holds the entity counters of a single kind in a namespace
+type KindSummary struct {
+	Namespace string `json:"namespace"`
+	Kind      string `json:"kind"`
+	Status    string `json:"status,omitempty"` // "added" or "removed" when the kind only exists on one side of a compare
+	Unchanged int    `json:"unchanged"`
+	Created   int    `json:"created"`
+	Updated   int    `json:"updated"`
+	Deleted   int    `json:"deleted"`
+	Failed    int    `json:"failed"`
+	Skipped   int    `json:"skipped"` // changes skipped during an apply review
+	Moved     int    `json:"moved"`   // entities whose order-insensitive arrays were only reordered
+}
+
+// empty reports whether nothing was counted for the kind
+func (ks *KindSummary) empty() bool {
+	return ks.Status == "" && ks.Unchanged+ks.Created+ks.Updated+ks.Deleted+ks.Failed+ks.Skipped+ks.Moved == 0
+}
+
+// RunSummary collects the per kind counters of a download, compare or apply run
+type RunSummary struct {
+	kinds map[string]*KindSummary
+}
+
+func newRunSummary() *RunSummary {
+	return &RunSummary{kinds: make(map[string]*KindSummary)}
+}
+
+// Kind returns the counters for the kind in the namespace, creating them on first use
+func (s *RunSummary) Kind(namespace, kind string) *KindSummary {
+	id := namespace + "/" + kind
+	ks, ok := s.kinds[id]
+	if !ok {
+		ks = &KindSummary{Namespace: namespace, Kind: kind}
+		s.kinds[id] = ks
+	}
+	return ks
+}
+
+// Kinds returns the collected counters sorted by namespace and kind
+func (s *RunSummary) Kinds() []*KindSummary {
+	var kinds []*KindSummary
+	for _, ks := range s.kinds {
+		kinds = append(kinds, ks)
+	}
+	sort.Slice(kinds, func(i, j int) bool {
+		if kinds[i].Namespace != kinds[j].Namespace {
+			return kinds[i].Namespace < kinds[j].Namespace
+		}
+		return kinds[i].Kind < kinds[j].Kind
+	})
+	return kinds
+}
+
+// empty reports whether nothing was counted for any kind
+func (s *RunSummary) empty() bool {
+	for _, ks := range s.kinds {
+		if !ks.empty() {
+			return false
+		}
+	}
+	return true
+}
+
+// HasFailures reports whether any file or entity failed during the run
+func (s *RunSummary) HasFailures() bool {
+	for _, ks := range s.kinds {
+		if ks.Failed > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// HasChanges reports whether any entity was (or would be) created, updated or deleted
+func (s *RunSummary) HasChanges() bool {
+	for _, ks := range s.kinds {
+		if ks.Status != "" || ks.Created+ks.Updated+ks.Deleted > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ExitCode maps the summary to the process exit code. Differences only count
+// as a distinct outcome for compare runs, where finding them is the point.
+func (s *RunSummary) ExitCode(reportDifferences bool) int {
+	if s.HasFailures() {
+		return exitPartialFailure
+	}
+	if reportDifferences && s.HasChanges() {
+		return exitDifferences
+	}
+	return exitSuccess
+}
+
+// Print displays the end-of-run table of counters per kind, or with JSON logging one log record
+// per kind so the output stays one JSON record per line
+func (s *RunSummary) Print() {
+	if !logAsJSON {
+		s.Fprint(os.Stdout)
+		return
+	}
+	if s.empty() {
+		return
+	}
+	for _, ks := range s.Kinds() {
+		logInfo("Run summary", "namespace", ks.Namespace, "kind", ks.Kind, "unchanged", ks.Unchanged, "created", ks.Created,
+			"updated", ks.Updated, "deleted", ks.Deleted, "failed", ks.Failed, "skipped", ks.Skipped, "moved", ks.Moved, "status", ks.Status)
+	}
+}
+
+// Fprint writes the table of counters per kind to w, or nothing when every counter is zero, as
+// after a validate or lint that found no problems
+func (s *RunSummary) Fprint(w io.Writer) {
+	kinds := s.Kinds()
+	if s.empty() {
+		return
+	}
+
+	fmt.Fprintln(w, colorBlue+"Run summary:"+colorReset)
+	fmt.Fprintf(w, "%s%-20s %-20s %9s %7s %7s %7s %6s %7s %5s  %s%s\n", colorBlue,
+		"NAMESPACE", "KIND", "UNCHANGED", "CREATED", "UPDATED", "DELETED", "FAILED", "SKIPPED", "MOVED", "STATUS", colorReset)
+	for _, ks := range kinds {
+		color := colorGreen
+		if ks.Failed > 0 {
+			color = colorRed
+		} else if ks.Created+ks.Updated+ks.Deleted > 0 {
+			color = colorYellow
+		}
+		fmt.Fprintf(w, "%s%-20s %-20s %9d %7d %7d %7d %6d %7d %5d  %s%s\n", color,
+			ks.Namespace, ks.Kind, ks.Unchanged, ks.Created, ks.Updated, ks.Deleted, ks.Failed, ks.Skipped, ks.Moved, ks.Status, colorReset)
+	}
+	fmt.Fprintln(w)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name              string
+		counters          KindSummary
+		reportDifferences bool
+		want              int
+	}{
+		{"nothing counted", KindSummary{}, true, exitSuccess},
+		{"unchanged only", KindSummary{Unchanged: 3}, true, exitSuccess},
+		{"differences in compare", KindSummary{Updated: 1}, true, exitDifferences},
+		{"added kind in compare", KindSummary{Status: "added"}, true, exitDifferences},
+		{"differences outside compare", KindSummary{Created: 2, Deleted: 1}, false, exitSuccess},
+		{"moved only", KindSummary{Moved: 1}, true, exitSuccess},
+		{"failures win over differences", KindSummary{Updated: 1, Failed: 1}, true, exitPartialFailure},
+		{"failures outside compare", KindSummary{Failed: 2}, false, exitPartialFailure},
+	}
+	for _, test := range tests {
+		summary := newRunSummary()
+		ks := summary.Kind("ns", "goals")
+		test.counters.Namespace, test.counters.Kind = ks.Namespace, ks.Kind
+		*ks = test.counters
+		if got := summary.ExitCode(test.reportDifferences); got != test.want {
+			t.Errorf("%s: ExitCode(%v) = %d, want %d", test.name, test.reportDifferences, got, test.want)
+		}
+	}
+}
+
+func TestFprintSkipsEmptySummary(t *testing.T) {
+	summary := newRunSummary()
+	summary.Kind("ns", "goals")
+	summary.Kind("ns", "pages")
+	var out bytes.Buffer
+	summary.Fprint(&out)
+	if out.Len() != 0 {
+		t.Errorf("an all-zero summary printed %q", out.String())
+	}
+
+	summary.Kind("ns", "pages").Failed++
+	summary.Fprint(&out)
+	for _, want := range []string{"Run summary:", "goals", "pages"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("summary output has no %q:\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+// Diff status of an entity between the downloaded data and the changes directory
+const (
+	statusUnchanged  = "unchanged"
+	statusModified   = "modified"
+	statusLocalOnly  = "local only"
+	statusRemoteOnly = "remote only"
+)
+
+// browserEntity is one entity shown in the TUI, with its downloaded and local versions
+type browserEntity struct {
+	Namespace string
+	Kind      string
+	Remote    *OutputEntity
+	Local     *OutputEntity
+	Status    string
+	Diff      []string
+}
+
+// entity returns the local version of the entity when there is one, the downloaded one otherwise
+func (e *browserEntity) entity() *OutputEntity {
+	if e.Local != nil {
+		return e.Local
+	}
+	return e.Remote
+}
+
+// browserData holds the entities of every namespace and kind, keyed by namespace then kind
+type browserData struct {
+	kinds map[string]map[string][]*browserEntity
+}
+
+// readKindFile reads the entities of a kind file, returning nil when the file does not exist
+func readKindFile(path string) ([]OutputEntity, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var entities []OutputEntity
+	if err := json.Unmarshal(data, &entities); err != nil {
+		return nil, fmt.Errorf("error unmarshalling JSON in file %s: %v", path, err)
+	}
+	return entities, nil
+}
+
+// loadBrowserData pairs the entities downloaded into outputDir with those in applyDir for the
+// configured kinds and any kind file found in either directory
+func loadBrowserData(config Config, outputDir, applyDir string) (*browserData, error) {
+	rules, err := newDiffRules(config)
+	if err != nil {
+		return nil, fmt.Errorf("invalid comparison rules: %v", err)
+	}
+
+	kindFiles := make(map[string]map[string]bool)
+	for _, kc := range config.Kinds {
+		if kindFiles[kc.Namespace] == nil {
+			kindFiles[kc.Namespace] = make(map[string]bool)
+		}
+		kindFiles[kc.Namespace][kc.Name+".json"] = true
+	}
+	for _, dir := range []string{outputDir, applyDir} {
+		files, err := listKindFiles(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for ns, names := range files {
+			if kindFiles[ns] == nil {
+				kindFiles[ns] = make(map[string]bool)
+			}
+			for name := range names {
+				kindFiles[ns][name] = true
+			}
+		}
+	}
+
+	data := &browserData{kinds: make(map[string]map[string][]*browserEntity)}
+	for ns, names := range kindFiles {
+		data.kinds[ns] = make(map[string][]*browserEntity)
+		for name := range names {
+			kind := strings.TrimSuffix(name, filepath.Ext(name))
+			remote, err := readKindFile(filepath.Join(outputDir, ns, name))
+			if err != nil {
+				return nil, err
+			}
+			localPath := filepath.Join(applyDir, ns, name)
+			local, err := readKindFile(localPath)
+			if err != nil {
+				return nil, err
+			}
+			_, err = os.Stat(localPath)
+			data.kinds[ns][kind] = pairEntities(ns, kind, remote, local, err == nil, rules.forKind(ns, kind))
+		}
+	}
+	return data, nil
+}
+
+// pairEntities matches downloaded and local entities by key and computes their diff status.
+// Without a local kind file the kind has no local changes and its downloaded entities are
+// unchanged; with one, the downloaded entities it leaves out are remote only.
+func pairEntities(namespace, kind string, remote, local []OutputEntity, hasLocalFile bool, kindRules *kindRules) []*browserEntity {
+	remoteStatus := statusUnchanged
+	if hasLocalFile {
+		remoteStatus = statusRemoteOnly
+	}
+	var entities []*browserEntity
+	byKey := make(map[string]*browserEntity)
+	for i := range remote {
+		entity := &browserEntity{Namespace: namespace, Kind: kind, Remote: &remote[i], Status: remoteStatus}
+		byKey[entityKeyString(remote[i])] = entity
+		entities = append(entities, entity)
+	}
+	for i := range local {
+		if existing, ok := byKey[entityKeyString(local[i])]; ok && local[i].ID != "" {
+			existing.Local = &local[i]
+			existing.Diff = kindRules.diffData(existing.Remote.Data, local[i].Data)
+			existing.Status = statusUnchanged
+			if len(existing.Diff) > 0 {
+				existing.Status = statusModified
+			}
+			continue
+		}
+		entities = append(entities, &browserEntity{Namespace: namespace, Kind: kind, Local: &local[i], Status: statusLocalOnly})
+	}
+	return entities
+}
+
+// countStatuses returns how many entities of a kind have each status
+func countStatuses(entities []*browserEntity) map[string]int {
+	counts := make(map[string]int)
+	for _, entity := range entities {
+		counts[entity.Status]++
+	}
+	return counts
+}
+
+// browser is the full-screen terminal UI for browsing namespaces, kinds and entities
+type browser struct {
+	config    Config
+	outputDir string
+	applyDir  string
+
+	app     *tview.Application
+	pages   *tview.Pages
+	tree    *tview.TreeView
+	details *tview.TextView
+	logs    *tview.TextView
+	busy    bool
+}
+
+// selection is what the current tree node stands for; empty fields match everything
+type selection struct {
+	Namespace string
+	Kind      string
+	Key       string
+}
+
+// runBrowser starts the terminal UI and blocks until it is closed
+func runBrowser(config Config, outputDir, applyDir string) error {
+	b := &browser{
+		config:    config,
+		outputDir: outputDir,
+		applyDir:  applyDir,
+		app:       tview.NewApplication(),
+		tree:      tview.NewTreeView(),
+		details:   tview.NewTextView(),
+		logs:      tview.NewTextView(),
+	}
+
+	b.tree.SetBorder(true).SetTitle(" Namespaces / kinds / entities ")
+	b.details.SetDynamicColors(true).SetWrap(false).SetBorder(true).SetTitle(" Entity ")
+	b.logs.SetDynamicColors(true).SetScrollable(true).SetBorder(true).SetTitle(" Log ")
+	b.logs.SetChangedFunc(func() { b.app.Draw() })
+	b.tree.SetChangedFunc(b.showNode)
+	b.tree.SetSelectedFunc(func(node *tview.TreeNode) {
+		node.SetExpanded(!node.IsExpanded())
+	})
+
+	help := tview.NewTextView().SetDynamicColors(true).SetText(
+		"[yellow]enter[-] expand  [yellow]d[-] download  [yellow]c[-] compare  [yellow]p[-] dry-run apply  [yellow]a[-] apply  [yellow]tab[-] switch pane  [yellow]q[-] quit  (actions work on the selected node)")
+
+	main := tview.NewFlex().
+		AddItem(b.tree, 0, 1, true).
+		AddItem(b.details, 0, 2, false)
+	layout := tview.NewFlex().SetDirection(tview.FlexRow).
+		AddItem(main, 0, 3, true).
+		AddItem(b.logs, 8, 0, false).
+		AddItem(help, 1, 0, false)
+	b.pages = tview.NewPages().AddPage("main", layout, true, true)
+
+	b.app.SetInputCapture(b.handleKey)
+
+	// Log records go to the log pane while the UI owns the terminal
+	setLogOutput(tview.ANSIWriter(b.logs))
+	defer setLogOutput(os.Stdout)
+
+	if err := b.reload(); err != nil {
+		return err
+	}
+	return b.app.SetRoot(b.pages, true).Run()
+}
+
+func (b *browser) handleKey(event *tcell.EventKey) *tcell.EventKey {
+	if name, _ := b.pages.GetFrontPage(); name != "main" {
+		return event
+	}
+	switch {
+	case event.Key() == tcell.KeyTab:
+		if b.tree.HasFocus() {
+			b.app.SetFocus(b.details)
+		} else {
+			b.app.SetFocus(b.tree)
+		}
+		return nil
+	case event.Rune() == 'q':
+		b.app.Stop()
+		return nil
+	case event.Rune() == 'd':
+		b.download(false)
+		return nil
+	case event.Rune() == 'c':
+		b.download(true)
+		return nil
+	case event.Rune() == 'p':
+		b.confirmApply(true)
+		return nil
+	case event.Rune() == 'a':
+		b.confirmApply(false)
+		return nil
+	}
+	return event
+}
+
+// reload reads the downloaded and local data again and rebuilds the tree, keeping the selection
+func (b *browser) reload() error {
+	data, err := loadBrowserData(b.config, b.outputDir, b.applyDir)
+	if err != nil {
+		return err
+	}
+
+	previous := b.currentSelection()
+
+	root := tview.NewTreeNode(fmt.Sprintf("%s (%s vs %s)", b.config.ProjectID, b.outputDir, b.applyDir)).
+		SetReference(selection{}).SetColor(tcell.ColorBlue)
+	current := root
+
+	namespaces := sortedKeys(data.kinds)
+	for _, ns := range namespaces {
+		nsNode := tview.NewTreeNode(ns).SetReference(selection{Namespace: ns}).SetColor(tcell.ColorTeal)
+		root.AddChild(nsNode)
+		if previous == (selection{Namespace: ns}) {
+			current = nsNode
+		}
+
+		// Entities of every kind in the namespace can be children of an entity of another kind
+		children := make(map[string][]*browserEntity)
+		for _, entities := range data.kinds[ns] {
+			for _, entity := range entities {
+				if parent := entity.entity().Parent; parent != "" {
+					children[parent] = append(children[parent], entity)
+				}
+			}
+		}
+
+		for _, kind := range sortedKeys(data.kinds[ns]) {
+			entities := data.kinds[ns][kind]
+			counts := countStatuses(entities)
+			label := fmt.Sprintf("%s (%d)", kind, len(entities))
+			if changed := counts[statusModified] + counts[statusLocalOnly] + counts[statusRemoteOnly]; changed > 0 {
+				label += fmt.Sprintf(" [yellow]%d changed[-]", changed)
+			}
+			kindNode := tview.NewTreeNode(label).SetReference(selection{Namespace: ns, Kind: kind}).SetExpanded(false)
+			nsNode.AddChild(kindNode)
+			if previous == (selection{Namespace: ns, Kind: kind}) {
+				current = kindNode
+			}
+			for _, entity := range entities {
+				if node := b.entityNode(entity, children, previous, &current, 0); node != nil {
+					kindNode.AddChild(node)
+				}
+			}
+		}
+	}
+
+	b.tree.SetRoot(root).SetCurrentNode(current)
+	b.showNode(current)
+	return nil
+}
+
+// entityNode builds the node of an entity and, following parent links, of its child entities
+func (b *browser) entityNode(entity *browserEntity, children map[string][]*browserEntity, previous selection, current **tview.TreeNode, depth int) *tview.TreeNode {
+	e := entity.entity()
+	ref := selection{Namespace: entity.Namespace, Kind: entity.Kind, Key: entityKeyString(*e)}
+	node := tview.NewTreeNode(entityLabel(entity)).SetReference(entity).SetExpanded(false)
+	if previous == ref {
+		*current = node
+	}
+	// Parent links never form cycles in Datastore, the depth guard only protects against bad local files
+	if depth < 10 && e.ID != "" {
+		for _, child := range children[entity.Kind+","+e.ID] {
+			node.AddChild(b.entityNode(child, children, previous, current, depth+1))
+		}
+	}
+	return node
+}
+
+// entityLabel renders an entity as "marker id  kind  hint", coloured by diff status
+func entityLabel(entity *browserEntity) string {
+	e := entity.entity()
+	marker, color := "=", "white"
+	switch entity.Status {
+	case statusModified:
+		marker, color = "M", "yellow"
+	case statusLocalOnly:
+		marker, color = "+", "green"
+	case statusRemoteOnly:
+		marker, color = "-", "red"
+	}
+	id := e.ID
+	if id == "" {
+		id = "(new)"
+	}
+	label := fmt.Sprintf("[%s]%s %s %s[-]", color, marker, entity.Kind, tview.Escape(id))
+	for _, field := range []string{"variable", "name", "title", "page", "type"} {
+		if value, ok := e.Data[field].(string); ok && value != "" {
+			label += " " + tview.Escape(value)
+			break
+		}
+	}
+	return label
+}
+
+// showNode displays the JSON and diff of the selected entity, or a summary of a namespace or kind
+func (b *browser) showNode(node *tview.TreeNode) {
+	if node == nil {
+		return
+	}
+	b.details.Clear()
+	b.details.ScrollToBeginning()
+
+	entity, ok := node.GetReference().(*browserEntity)
+	if !ok {
+		fmt.Fprintf(b.details, "[blue]%s[-]\n\n", tview.Escape(node.GetText()))
+		fmt.Fprintln(b.details, "d downloads, c compares and a applies everything below this node.")
+		return
+	}
+
+	e := entity.entity()
+	fmt.Fprintf(b.details, "[blue]%s/%s %s[-]  status: [yellow]%s[-]\n", entity.Namespace, entity.Kind, tview.Escape(e.ID), entity.Status)
+	if e.Parent != "" {
+		fmt.Fprintf(b.details, "parent: %s\n", tview.Escape(e.Parent))
+	}
+	if len(entity.Diff) > 0 {
+		fmt.Fprintln(b.details, "\n[yellow]Differences (downloaded -> local):[-]")
+		for _, line := range entity.Diff {
+			fmt.Fprintln(b.details, "  "+tview.Escape(line))
+		}
+	}
+	jsonData, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		fmt.Fprintf(b.details, "[red]%v[-]\n", err)
+		return
+	}
+	fmt.Fprintln(b.details)
+	fmt.Fprint(b.details, tview.Escape(string(jsonData)))
+}
+
+// currentSelection returns the namespace, kind and entity the current node stands for
+func (b *browser) currentSelection() selection {
+	node := b.tree.GetCurrentNode()
+	if node == nil {
+		return selection{}
+	}
+	switch ref := node.GetReference().(type) {
+	case selection:
+		return ref
+	case *browserEntity:
+		return selection{Namespace: ref.Namespace, Kind: ref.Kind, Key: entityKeyString(*ref.entity())}
+	}
+	return selection{}
+}
+
+// runAction runs a long operation in the background, then reloads the tree
+func (b *browser) runAction(name string, action func() error) {
+	if b.busy {
+		logWarn("Another operation is still running")
+		return
+	}
+	b.busy = true
+	go func() {
+		err := action()
+		b.app.QueueUpdateDraw(func() {
+			b.busy = false
+			if err != nil {
+				logError(fmt.Sprintf("%s failed: %v", name, err))
+			}
+			if err := b.reload(); err != nil {
+				logError(fmt.Sprintf("Failed to reload data: %v", err))
+			}
+		})
+	}()
+}
+
+// download refreshes the downloaded data of the selected namespace or kind; compare reports the
+// differences with the changes directory afterwards
+func (b *browser) download(compare bool) {
+	sel := b.currentSelection()
+	config := b.config
+	config.Kinds = nil
+	for _, kc := range b.config.Kinds {
+		if (sel.Namespace == "" || kc.Namespace == sel.Namespace) && (sel.Kind == "" || kc.Name == sel.Kind) {
+			config.Kinds = append(config.Kinds, kc)
+		}
+	}
+	if len(config.Kinds) == 0 {
+		logWarn("The selection has no configured kinds to download")
+		return
+	}
+
+	b.runAction("Download", func() error {
+		logInfo("Starting download...")
+		if err := retrieveAndSaveJSON(config, b.outputDir); err != nil {
+			return err
+		}
+		logSuccess("Data downloaded successfully.")
+		if !compare {
+			return nil
+		}
+		data, err := loadBrowserData(b.config, b.outputDir, b.applyDir)
+		if err != nil {
+			return err
+		}
+		summary := newRunSummary()
+		for _, kc := range config.Kinds {
+			ks := summary.Kind(kc.Namespace, kc.Name)
+			for _, entity := range data.kinds[kc.Namespace][kc.Name] {
+				switch entity.Status {
+				case statusUnchanged:
+					ks.Unchanged++
+				case statusModified:
+					ks.Updated++
+				case statusLocalOnly:
+					ks.Created++
+				case statusRemoteOnly:
+					ks.Deleted++
+				}
+			}
+		}
+		summary.Fprint(tview.ANSIWriter(b.logs))
+		return nil
+	})
+}
+
+// confirmApply asks before applying the local changes of the selection
+func (b *browser) confirmApply(dryRun bool) {
+	sel := b.currentSelection()
+	target := "everything"
+	if sel.Namespace != "" {
+		target = strings.Trim(sel.Namespace+"/"+sel.Kind+" "+sel.Key, "/ ")
+	}
+	mode := "Apply"
+	if dryRun {
+		mode = "Dry-run apply"
+	}
+
+	modal := tview.NewModal().
+		SetText(fmt.Sprintf("%s the local changes of %s to project %s?", mode, target, b.config.ProjectID)).
+		AddButtons([]string{mode, "Cancel"}).
+		SetDoneFunc(func(_ int, label string) {
+			b.pages.RemovePage("confirm")
+			b.app.SetFocus(b.tree)
+			if label != mode {
+				return
+			}
+			b.runAction(mode, func() error {
+				summary := newRunSummary()
+				opts := applyOptions{DryRun: dryRun, BaseDir: b.outputDir, Only: func(change *PlannedChange) bool {
+					return (sel.Namespace == "" || change.Namespace == sel.Namespace) &&
+						(sel.Kind == "" || change.Kind == sel.Kind) &&
+						(sel.Key == "" || entityKeyString(OutputEntity{ID: change.ID, Parent: change.Parent}) == sel.Key)
+				}}
+				err := applyChangesToDatabase(b.config, b.applyDir, opts, summary)
+				summary.Fprint(tview.ANSIWriter(b.logs))
+				if err == nil && !dryRun && !summary.HasFailures() {
+					// Fetch what was written so the statuses reflect the new remote state
+					config := b.config
+					config.Kinds = nil
+					for _, ks := range summary.Kinds() {
+						for _, kc := range b.config.Kinds {
+							if kc.Namespace == ks.Namespace && kc.Name == ks.Kind {
+								config.Kinds = append(config.Kinds, kc)
+							}
+						}
+					}
+					if len(config.Kinds) > 0 {
+						err = retrieveAndSaveJSON(config, b.outputDir)
+					}
+				}
+				return err
+			})
+		})
+	b.pages.AddPage("confirm", modal, true, true)
+}
+
+// sortedKeys returns the keys of a map in order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// VariableUsageConfig tells the variable analysis where variables are defined and used.
+// Variables belong to the goal of their parent (a goalsConfig entity) or, without a parent,
+// to every goal; pages use the variables of the goal they are a child of.
+type VariableUsageConfig struct {
+	Kind            string   `yaml:"kind"`            // kind defining the variables, default variables
+	PageKinds       []string `yaml:"pageKinds"`       // kinds using them, default pages
+	UsageProperties []string `yaml:"usageProperties"` // properties naming a variable, default variable and updatesVariable
+	Ignore          []string `yaml:"ignore"`          // names that are not variables, e.g. custom
+}
+
+// withDefaults fills in the defaults of the unset settings
+func (c VariableUsageConfig) withDefaults() VariableUsageConfig {
+	if c.Kind == "" {
+		c.Kind = "variables"
+	}
+	if len(c.PageKinds) == 0 {
+		c.PageKinds = []string{"pages"}
+	}
+	if len(c.UsageProperties) == 0 {
+		c.UsageProperties = []string{"variable", "updatesVariable"}
+	}
+	return c
+}
+
+// variableUse is one place a page uses a variable
+type variableUse struct {
+	page *lintEntity
+	kind string
+	path string
+}
+
+// analyzeVariables cross-references the variables of every namespace with the pages using them and
+// checks the input ranges. Undefined variables and invalid ranges are logged as errors and the
+// entities having them counted once as failures, unused variables are logged as warnings. It
+// returns the number of errors.
+func analyzeVariables(config Config, data lintData, summary *RunSummary) int {
+	settings := config.VariableUsage.withDefaults()
+	ignored := make(map[string]bool)
+	for _, name := range settings.Ignore {
+		ignored[name] = true
+	}
+	usageProperties := make(map[string]bool)
+	for _, property := range settings.UsageProperties {
+		usageProperties[property] = true
+	}
+
+	errors := 0
+	for _, namespace := range sortedKeys(data) {
+		variables := data[namespace][settings.Kind]
+		if len(variables) == 0 {
+			continue
+		}
+		kindSummary := summary.Kind(namespace, settings.Kind)
+
+		// Variables by goal ("" for the ones shared by every goal) and name
+		defined := make(map[string]map[string]*lintEntity)
+		for _, variable := range variables {
+			name, _ := variable.entity.Data["variable"].(string)
+			if name == "" {
+				continue
+			}
+			goal := variable.entity.Parent
+			if defined[goal] == nil {
+				defined[goal] = make(map[string]*lintEntity)
+			}
+			defined[goal][name] = variable
+			errors += checkVariableRange(config, namespace, settings.Kind, variable, kindSummary)
+		}
+
+		// Uses by goal and name
+		used := make(map[string]map[string][]variableUse)
+		for _, pageKind := range settings.PageKinds {
+			for _, page := range data[namespace][pageKind] {
+				goal := page.entity.Parent
+				for _, use := range collectVariableUses(page.value, usageProperties, "") {
+					if ignored[use.name] {
+						continue
+					}
+					if used[goal] == nil {
+						used[goal] = make(map[string][]variableUse)
+					}
+					used[goal][use.name] = append(used[goal][use.name], variableUse{page: page, kind: pageKind, path: use.path})
+				}
+			}
+		}
+
+		// Pages are counted as failed once, however many undefined variables they use
+		failedPages := make(map[*lintEntity]bool)
+		for _, goal := range sortedKeys(used) {
+			for _, name := range sortedKeys(used[goal]) {
+				if defined[goal][name] != nil || defined[""][name] != nil {
+					continue
+				}
+				for _, use := range used[goal][name] {
+					key := entityKeyString(use.page.entity)
+					errors++
+					if !failedPages[use.page] {
+						failedPages[use.page] = true
+						summary.Kind(namespace, use.kind).Failed++
+					}
+					logError(fmt.Sprintf("%s: entity %s: %s: variable %q is not defined for %s%s", use.page.file, key, use.path, name, goalLabel(data, namespace, goal), suggestVariable(name, defined[goal], defined[""])),
+						entityFields(config.ProjectID, namespace, use.kind, key)...)
+				}
+			}
+		}
+
+		for _, goal := range sortedKeys(defined) {
+			for _, name := range sortedKeys(defined[goal]) {
+				isUsed := len(used[goal][name]) > 0
+				if goal == "" {
+					for _, uses := range used {
+						isUsed = isUsed || len(uses[name]) > 0
+					}
+				}
+				if !isUsed {
+					variable := defined[goal][name]
+					key := entityKeyString(variable.entity)
+					logWarn(fmt.Sprintf("%s: entity %s: variable %q of %s is not used by any page", variable.file, key, name, goalLabel(data, namespace, goal)),
+						entityFields(config.ProjectID, namespace, settings.Kind, key)...)
+				}
+			}
+		}
+
+		for _, goal := range sortedKeys(defined) {
+			uses := 0
+			for _, name := range sortedKeys(defined[goal]) {
+				if len(used[goal][name]) > 0 {
+					uses++
+				}
+			}
+			logInfo(fmt.Sprintf("%s: %d variables, %d used by its pages", goalLabel(data, namespace, goal), len(defined[goal]), uses), "namespace", namespace)
+		}
+	}
+	return errors
+}
+
+// checkVariableRange validates the values of an input variable: minValue <= defaultValue <=
+// maxValue and a positive stepValue that divides the range. It returns the number of errors.
+func checkVariableRange(config Config, namespace, kind string, variable *lintEntity, kindSummary *KindSummary) int {
+	values, ok := variable.entity.Data["values"].(map[string]interface{})
+	if !ok || variable.entity.Data["type"] != "input" {
+		return 0
+	}
+	number := func(name string) (float64, bool) {
+		return toFloat(values[name])
+	}
+	minValue, hasMin := number("minValue")
+	maxValue, hasMax := number("maxValue")
+	defaultValue, hasDefault := number("defaultValue")
+	stepValue, hasStep := number("stepValue")
+
+	var problems []string
+	switch {
+	case !hasMin || !hasMax || !hasDefault || !hasStep:
+		problems = append(problems, "minValue, maxValue, defaultValue and stepValue must all be numbers")
+	default:
+		if minValue > maxValue {
+			problems = append(problems, fmt.Sprintf("minValue %v is greater than maxValue %v", minValue, maxValue))
+		}
+		if defaultValue < minValue || defaultValue > maxValue {
+			problems = append(problems, fmt.Sprintf("defaultValue %v is outside [%v, %v]", defaultValue, minValue, maxValue))
+		}
+		if stepValue <= 0 {
+			problems = append(problems, fmt.Sprintf("stepValue %v must be positive", stepValue))
+		} else if steps := (maxValue - minValue) / stepValue; math.Abs(steps-math.Round(steps)) > 1e-9 {
+			problems = append(problems, fmt.Sprintf("stepValue %v does not divide the range %v..%v", stepValue, minValue, maxValue))
+		}
+	}
+
+	key := entityKeyString(variable.entity)
+	for _, problem := range problems {
+		logError(fmt.Sprintf("%s: entity %s: variable %v: %s", variable.file, key, variable.entity.Data["variable"], problem),
+			entityFields(config.ProjectID, namespace, kind, key)...)
+	}
+	if len(problems) > 0 {
+		kindSummary.Failed++
+	}
+	return len(problems)
+}
+
+// namedUse is a variable name found at a property path
+type namedUse struct {
+	name string
+	path string
+}
+
+// collectVariableUses returns the string values of the usage properties anywhere in value
+func collectVariableUses(value interface{}, usageProperties map[string]bool, path string) []namedUse {
+	var uses []namedUse
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for _, key := range sortedKeys(v) {
+			childPath := joinPath(path, key)
+			if name, ok := v[key].(string); ok && usageProperties[key] && name != "" {
+				uses = append(uses, namedUse{name: name, path: childPath})
+				continue
+			}
+			uses = append(uses, collectVariableUses(v[key], usageProperties, childPath)...)
+		}
+	case []interface{}:
+		for i, item := range v {
+			uses = append(uses, collectVariableUses(item, usageProperties, fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	return uses
+}
+
+// goalLabel names a goal by its goalsConfig key and, when known, the goal it configures
+func goalLabel(data lintData, namespace, goal string) string {
+	if goal == "" {
+		return "every goal"
+	}
+	kind, id, _ := strings.Cut(goal, ",")
+	for _, le := range data[namespace][kind] {
+		if le.entity.ID == id && le.entity.Parent != "" {
+			_, parentID, _ := strings.Cut(le.entity.Parent, ",")
+			return fmt.Sprintf("%s %s (%s)", kind, id, parentID)
+		}
+	}
+	return kind + " " + id
+}
+
+// suggestVariable points at a defined variable whose name differs only by a small typo
+func suggestVariable(name string, definitions ...map[string]*lintEntity) string {
+	candidates := make(map[string]interface{})
+	for _, defined := range definitions {
+		for candidate := range defined {
+			candidates[candidate] = nil
+		}
+	}
+	return suggestProperty(name, candidates)
+}
@@ -85,9 +85,7 @@ getArrayEntity = (data) => {
 
     return {
         "arrayValue": {
-            "values": [
-                entities
-                ]
+            "values": entities
         }
     }
 }
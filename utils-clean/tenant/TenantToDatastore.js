@@ -1,5 +1,5 @@
 const fs = require('fs');
-const {getI18N, getImages, getStringValue, getColors, buildEntity} = require("../utils");
+const {getI18N, getImages, getStringValue, getColors, buildEntity, getCTAEntity} = require("../utils");
 
 rawData = fs.readFileSync("./tenant.json")
 input = JSON.parse(rawData);
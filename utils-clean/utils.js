@@ -71,9 +71,7 @@ getCTAArrayEntity = (data) => {
 
     return {
         "arrayValue": {
-            "values": [
-                entities
-            ]
+            "values": entities
         }
     }
 }
@@ -148,24 +146,14 @@ getArrayEntity = (data) => {
 
     let entities = data.map(el => buildEntity(el));
 
-    return {
-        "arrayValue": {
-            "values": [
-                entities
-            ]
-        }
-    }
-}
-getArrayEntityOK = (data) => {
-
-    let entities = data.map(el => buildEntity(el));
-
     return {
         "arrayValue": {
             "values": entities
         }
     }
 }
+// Kept for the scripts written while getArrayEntity nested its values in another array
+getArrayEntityOK = getArrayEntity
 
 
 module.exports = {